@@ -0,0 +1,111 @@
+package restservice
+
+import (
+	"errors"
+	"github.com/straumur/straumur"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSyncTimeout    = 5 * time.Second
+	DefaultLateAckTimeout = time.Minute
+	syncParam             = "sync"
+)
+
+var (
+	ErrSaveTimeout = errors.New("Timed out waiting for save")
+)
+
+// Keeps track of events whose submitters are waiting for the
+// consumer of Updates() to confirm the save
+type ackRegistry struct {
+	sync.Mutex
+	pending map[*straumur.Event]chan error
+}
+
+func newAckRegistry() *ackRegistry {
+	return &ackRegistry{pending: make(map[*straumur.Event]chan error)}
+}
+
+// Registers e and returns the channel its acknowledgement arrives on
+func (a *ackRegistry) add(e *straumur.Event) <-chan error {
+	a.Lock()
+	defer a.Unlock()
+	ch := make(chan error, 1)
+	a.pending[e] = ch
+	return ch
+}
+
+func (a *ackRegistry) remove(e *straumur.Event) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.pending, e)
+}
+
+// Delivers the result of saving e, returns false when nobody waits
+func (a *ackRegistry) ack(e *straumur.Event, err error) bool {
+	a.Lock()
+	defer a.Unlock()
+	ch, ok := a.pending[e]
+	if !ok {
+		return false
+	}
+	delete(a.pending, e)
+	ch <- err
+	return true
+}
+
+// Confirms that an event received from Updates() has been persisted,
+// err is the result of the save. Consumers must call Ack for every
+// event: sync saves, PATCH and PUT with If-Match wait for it, the
+// latter two holding back later changes to the same event for up to
+// SyncTimeout. With a write-ahead log events are kept and, on error,
+// delivered again with a backoff until they are acknowledged. Failed
+// sync saves are not delivered again, their submitter got the error
+// and retries.
+func (r *RESTService) Ack(e *straumur.Event, err error) {
+	waited := r.acks.ack(e, err)
+	r.queue.ack(e, err, !waited)
+}
+
+// Queues e and waits for the consumer to Ack it. When the wait times
+// out late, if set, gets the result once the Ack arrives, or
+// ErrSaveTimeout if it doesn't within LateAckTimeout.
+func (r *RESTService) saveAndWait(e *straumur.Event, late func(error)) error {
+
+	done := r.acks.add(e)
+	if err := r.publish(e); err != nil {
+		r.acks.remove(e)
+		return err
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(r.SyncTimeout):
+	}
+
+	if late == nil {
+		r.acks.remove(e)
+		return ErrSaveTimeout
+	}
+	go func() {
+		select {
+		case err := <-done:
+			late(err)
+		case <-time.After(r.LateAckTimeout):
+			r.acks.remove(e)
+			late(ErrSaveTimeout)
+		}
+	}()
+	return ErrSaveTimeout
+}
+
+// Reports whether the caller asked for a synchronous save
+func isSync(req *http.Request) bool {
+	b, err := strconv.ParseBool(req.URL.Query().Get(syncParam))
+	return err == nil && b
+}
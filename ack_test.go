@@ -0,0 +1,37 @@
+package restservice
+
+import (
+	"errors"
+	"github.com/straumur/straumur"
+	"testing"
+	"time"
+)
+
+func TestSaveAndWait(t *testing.T) {
+
+	r := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	r.SyncTimeout = 100 * time.Millisecond
+
+	saveErr := errors.New("backend down")
+	go func() {
+		e := <-r.events
+		r.Ack(e, saveErr)
+	}()
+
+	if err := r.saveAndWait(&straumur.Event{}, nil); err != saveErr {
+		t.Errorf("Expected %v, got %v", saveErr, err)
+	}
+
+	go func() { <-r.events }()
+
+	if err := r.saveAndWait(&straumur.Event{}, nil); err != ErrSaveTimeout {
+		t.Errorf("Expected %v, got %v", ErrSaveTimeout, err)
+	}
+
+	if len(r.acks.pending) != 0 {
+		t.Errorf("Expected no pending acks, got %d", len(r.acks.pending))
+	}
+
+	// Acks for unknown events are ignored
+	r.Ack(&straumur.Event{}, nil)
+}
@@ -0,0 +1,255 @@
+package restservice
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Scopes granted to API keys
+const (
+	ScopeEventsRead    = "events:read"
+	ScopeEventsWrite   = "events:write"
+	ScopeAggregateRead = "aggregate:read"
+	ScopeAdmin         = "admin"
+	// Grants every scope
+	ScopeAll = "*"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+var (
+	ErrUnauthorized = errors.New("Missing or invalid credentials")
+	ErrForbidden    = errors.New("Insufficient scope")
+)
+
+// The authenticated caller of a request. Origins limits the origins
+// the principal may post events with and Entities the entities it may
+// read, empty lists allow everything. Tenant is used by the
+// PrincipalResolver in multi-tenant mode.
+type Principal struct {
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	Origins  []string `json:"origins,omitempty"`
+	Entities []string `json:"entities,omitempty"`
+	Tenant   string   `json:"tenant,omitempty"`
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAll {
+			return true
+		}
+	}
+	return false
+}
+
+// Identifies the caller of a request. Implementations return
+// ErrUnauthorized when credentials are missing or invalid.
+type Authenticator interface {
+	Authenticate(req *http.Request) (*Principal, error)
+}
+
+// Looks up the principal an API key belongs to, nil if the key is
+// unknown
+type KeyStore interface {
+	Lookup(key string) (*Principal, error)
+}
+
+// In-process KeyStore
+type MemoryKeyStore struct {
+	sync.RWMutex
+	keys map[string]*Principal
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: make(map[string]*Principal)}
+}
+
+func (m *MemoryKeyStore) Add(key string, p *Principal) {
+	m.Lock()
+	defer m.Unlock()
+	m.keys[key] = p
+}
+
+func (m *MemoryKeyStore) Remove(key string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.keys, key)
+}
+
+func (m *MemoryKeyStore) Lookup(key string) (*Principal, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.keys[key], nil
+}
+
+// Entry of a key file
+type keyEntry struct {
+	Key string `json:"key"`
+	Principal
+}
+
+// Loads API keys from a JSON file of the form
+//
+//	[{"key": "secret", "name": "dashboards", "scopes": ["events:read"],
+//	  "origins": ["teama"], "entities": ["teama/*"]}]
+func LoadKeyFile(path string) (*MemoryKeyStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []keyEntry{}
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	m := NewMemoryKeyStore()
+	for _, e := range entries {
+		if e.Key == "" {
+			return nil, errors.New("key file " + path + " has an entry without a key")
+		}
+		p := e.Principal
+		m.Add(e.Key, &p)
+	}
+	return m, nil
+}
+
+// Authenticates requests carrying an API key in the X-API-Key header
+// or as an Authorization bearer token
+type APIKeyAuthenticator struct {
+	Keys KeyStore
+}
+
+func NewAPIKeyAuthenticator(keys KeyStore) *APIKeyAuthenticator {
+	return &APIKeyAuthenticator{keys}
+}
+
+// Returns the API key sent with the request
+func apiKey(req *http.Request) string {
+	if key := req.Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+func (a *APIKeyAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	key := apiKey(req)
+	if key == "" {
+		return nil, ErrUnauthorized
+	}
+	p, err := a.Keys.Lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, ErrUnauthorized
+	}
+	return p, nil
+}
+
+// Returns the principal authenticated for the request, nil when
+// authentication is disabled
+func PrincipalFrom(req *http.Request) *Principal {
+	p, _ := req.Context().Value(principalKey).(*Principal)
+	return p
+}
+
+// Returns the principal of the request a websocket connection was
+// opened with
+func principalOf(ws *websocket.Conn) *Principal {
+	if req := ws.Request(); req != nil {
+		return PrincipalFrom(req)
+	}
+	return nil
+}
+
+// Authenticates the request and checks the principal has scope. On
+// success the returned request carries the principal. Requests that
+// already carry one, e.g. from a PrincipalResolver, aren't
+// authenticated again.
+func (r *RESTService) authorize(scope string, req *http.Request) (*http.Request, error, int) {
+
+	p := PrincipalFrom(req)
+	if p == nil {
+		if r.Auth == nil {
+			return req, nil, http.StatusOK
+		}
+		var err error
+		p, err = r.Auth.Authenticate(req)
+		if err == ErrUnauthorized {
+			return req, err, http.StatusUnauthorized
+		}
+		if err != nil {
+			return req, err, http.StatusInternalServerError
+		}
+	}
+	if !p.HasScope(scope) {
+		logFor(req).Warningf("Principal %s lacks scope %s for %s", p.Name, scope, req.URL)
+		return req, ErrForbidden, http.StatusForbidden
+	}
+
+	return withPrincipal(req, p), nil, http.StatusOK
+}
+
+// Returns a copy of req carrying the principal
+func withPrincipal(req *http.Request, p *Principal) *http.Request {
+	ctx := context.WithValue(req.Context(), principalKey, p)
+	return req.WithContext(ctx)
+}
+
+// Wraps a handler so it is only called for principals with scope
+func (r *RESTService) Scoped(scope string, f func(http.ResponseWriter, *http.Request) (error, int)) func(http.ResponseWriter, *http.Request) (error, int) {
+
+	return func(w http.ResponseWriter, req *http.Request) (error, int) {
+		req, err, status := r.authorize(scope, req)
+		if status == http.StatusUnauthorized {
+			if !r.allowUnauthorized(w, req) {
+				return ErrRateLimited, http.StatusTooManyRequests
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="straumur"`)
+		}
+		if err != nil {
+			return err, status
+		}
+		if !r.allow(w, req) {
+			return ErrRateLimited, http.StatusTooManyRequests
+		}
+		return f(w, req)
+	}
+}
+
+// Same as Scoped for plain handlers such as the websocket upgrade
+func (r *RESTService) ScopedHandler(scope string, f http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		req, err, status := r.authorize(scope, req)
+		if status == http.StatusUnauthorized && !r.allowUnauthorized(w, req) {
+			err, status = ErrRateLimited, http.StatusTooManyRequests
+		}
+		if err != nil {
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="straumur"`)
+			}
+			requestId(req)
+			writeError(w, req, err, status)
+			return
+		}
+		if !r.allow(w, req) {
+			writeError(w, req, ErrRateLimited, http.StatusTooManyRequests)
+			return
+		}
+		f(w, req)
+	}
+}
@@ -0,0 +1,118 @@
+package restservice
+
+import (
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+
+	keys := NewMemoryKeyStore()
+	keys.Add("reader-key", &Principal{Name: "reader", Scopes: []string{ScopeEventsRead}})
+	auth := NewAPIKeyAuthenticator(keys)
+
+	tests := []struct {
+		Header string
+		Value  string
+		Name   string
+		Err    error
+	}{
+		{apiKeyHeader, "reader-key", "reader", nil},
+		{"Authorization", "Bearer reader-key", "reader", nil},
+		{"Authorization", "Basic cmVhZGVyLWtleQ==", "", ErrUnauthorized},
+		{apiKeyHeader, "unknown", "", ErrUnauthorized},
+		{"", "", "", ErrUnauthorized},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/api/search", nil)
+		if test.Header != "" {
+			req.Header.Set(test.Header, test.Value)
+		}
+		p, err := auth.Authenticate(req)
+		if err != test.Err {
+			t.Errorf("%s: %s, expected %v, got %v", test.Header, test.Value, test.Err, err)
+		}
+		if err == nil && p.Name != test.Name {
+			t.Errorf("Expected principal %s, got %+v", test.Name, p)
+		}
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"key": "secret", "name": "producer", "scopes": ["events:write"]}]`)
+	f.Close()
+
+	keys, err := LoadKeyFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := keys.Lookup("secret")
+	if p == nil || p.Name != "producer" || !p.HasScope(ScopeEventsWrite) || p.HasScope(ScopeEventsRead) {
+		t.Errorf("Unexpected principal %+v", p)
+	}
+}
+
+func TestScopedRoutes(t *testing.T) {
+
+	keys := NewMemoryKeyStore()
+	keys.Add("reader-key", &Principal{Name: "reader", Scopes: []string{ScopeEventsRead}})
+	keys.Add("admin-key", &Principal{Name: "admin", Scopes: []string{ScopeAll}})
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.Auth = NewAPIKeyAuthenticator(keys)
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	tests := []struct {
+		Path   string
+		Key    string
+		Status int
+	}{
+		{"/api/search", "", http.StatusUnauthorized},
+		{"/api/search", "wrong-key", http.StatusUnauthorized},
+		{"/api/search", "reader-key", http.StatusOK},
+		{"/api/aggregate/actors", "reader-key", http.StatusForbidden},
+		{"/api/aggregate/actors", "admin-key", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", server.URL+test.Path, nil)
+		if test.Key != "" {
+			req.Header.Set("Authorization", "Bearer "+test.Key)
+		}
+		r, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if r.StatusCode != test.Status {
+			t.Errorf("%s with %q: expected %d, got %d", test.Path, test.Key, test.Status, r.StatusCode)
+		}
+		if test.Status == http.StatusUnauthorized && r.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: missing WWW-Authenticate header", test.Path)
+		}
+	}
+
+	r, err := http.Get(fmt.Sprintf("%s/api/ws", server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Errorf("/api/ws: expected %d, got %d", http.StatusUnauthorized, r.StatusCode)
+	}
+}
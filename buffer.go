@@ -0,0 +1,152 @@
+package restservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+const DefaultBufferSize = 64
+
+// What to do with a broadcast when a client's queue is full
+type SlowConsumerPolicy int
+
+const (
+	// Remove the client, the default
+	PolicyDisconnect SlowConsumerPolicy = iota
+	// Discard the oldest queued message to make room
+	PolicyDropOldest
+	// Discard the message being sent
+	PolicyDropNewest
+)
+
+var policyNames = map[SlowConsumerPolicy]string{
+	PolicyDisconnect: "disconnect",
+	PolicyDropOldest: "drop-oldest",
+	PolicyDropNewest: "drop-newest",
+}
+
+func (p SlowConsumerPolicy) String() string {
+	if s, ok := policyNames[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("SlowConsumerPolicy(%d)", int(p))
+}
+
+func (p SlowConsumerPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *SlowConsumerPolicy) UnmarshalText(b []byte) error {
+	parsed, err := ParseSlowConsumerPolicy(string(b))
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// Parses a policy name such as "drop-oldest"
+func ParseSlowConsumerPolicy(s string) (SlowConsumerPolicy, error) {
+	for p, name := range policyNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown slow consumer policy %q", s)
+}
+
+// Delivery counters of a client. A slow client keeps sending while
+// its dropped count grows, a dead one stops sending.
+type ClientStats struct {
+	Id      string             `json:"id"`
+	Queued  int                `json:"queued"`
+	Size    int                `json:"size"`
+	Sent    uint64             `json:"sent"`
+	Dropped uint64             `json:"dropped"`
+	Policy  SlowConsumerPolicy `json:"policy"`
+}
+
+func (c *Client) Stats() ClientStats {
+	return ClientStats{
+		Id:      c.Id,
+		Queued:  len(c.ch),
+		Size:    cap(c.ch),
+		Sent:    atomic.LoadUint64(&c.sent),
+		Dropped: atomic.LoadUint64(&c.dropped),
+		Policy:  c.policy,
+	}
+}
+
+// Queues msg for the writer, applying the policy when the queue is full
+func (c *Client) send(msg interface{}) {
+
+	select {
+	case c.ch <- msg:
+		return
+	default:
+	}
+
+	atomic.AddUint64(&c.dropped, 1)
+
+	if atomic.LoadInt32(&c.replaying) == 1 {
+		logger.Debugf("Dropped message for client %s while it replays", c.Id)
+		return
+	}
+
+	switch c.policy {
+
+	case PolicyDropNewest:
+		logger.Debugf("Dropped newest message for client %s", c.Id)
+
+	case PolicyDropOldest:
+		logger.Debugf("Dropped oldest message for client %s", c.Id)
+		select {
+		case <-c.ch:
+		default:
+		}
+		select {
+		case c.ch <- msg:
+		default:
+			atomic.AddUint64(&c.dropped, 1)
+		}
+
+	default:
+		// Called from the Run loop, which also serves Err. Closing
+		// may block on a full connection, so it is done once outside
+		// of it, the reader or stream handler then removes the client.
+		if c.markClosed("slow consumer") {
+			go func() {
+				c.closeConn()
+				c.server.Err(fmt.Errorf("client %s is disconnected.", c.Id))
+			}()
+		}
+	}
+}
+
+// Returns the delivery counters of every connected client
+func (s *WebSocketServer) Stats() []ClientStats {
+	ch := make(chan []ClientStats)
+	select {
+	case s.statsCh <- ch:
+	case <-s.stopped:
+		return []ClientStats{}
+	}
+	return <-ch
+}
+
+func (s *WebSocketServer) clientStats() []ClientStats {
+	stats := []ClientStats{}
+	for _, c := range s.clients {
+		stats = append(stats, c.Stats())
+	}
+	return stats
+}
+
+// GET: /api/clients
+func (r *RESTService) clientsHandler(w http.ResponseWriter, req *http.Request) (error, int) {
+	enc := json.NewEncoder(w)
+	enc.Encode(r.WsServer.Stats())
+	return nil, http.StatusOK
+}
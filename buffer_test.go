@@ -0,0 +1,131 @@
+package restservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSlowConsumerPolicy(t *testing.T) {
+
+	tests := []struct {
+		Policy   SlowConsumerPolicy
+		Expected string
+	}{
+		{PolicyDropOldest, "[3 4]"},
+		{PolicyDropNewest, "[1 2]"},
+	}
+
+	for _, test := range tests {
+		c := &Client{
+			Id:     "slow",
+			ch:     make(chan interface{}, 2),
+			policy: test.Policy,
+		}
+		for i := 1; i <= 4; i++ {
+			c.Write(&straumur.Event{ID: i})
+		}
+		queued := []*straumur.Event{}
+		for len(c.ch) > 0 {
+			queued = append(queued, (<-c.ch).(*straumur.Event))
+		}
+		if fmt.Sprint(ids(queued)) != test.Expected {
+			t.Errorf("%s: expected %s, got %v", test.Policy, test.Expected, ids(queued))
+		}
+		if stats := c.Stats(); stats.Dropped != 2 {
+			t.Errorf("%s: expected 2 dropped, got %+v", test.Policy, stats)
+		}
+	}
+}
+
+func TestParseSlowConsumerPolicy(t *testing.T) {
+
+	for _, p := range []SlowConsumerPolicy{PolicyDisconnect, PolicyDropOldest, PolicyDropNewest} {
+		parsed, err := ParseSlowConsumerPolicy(p.String())
+		if err != nil || parsed != p {
+			t.Errorf("Expected %s, got %s, %v", p, parsed, err)
+		}
+	}
+
+	if _, err := ParseSlowConsumerPolicy("block"); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+
+	b, err := json.Marshal(ClientStats{Policy: PolicyDropOldest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats map[string]interface{}
+	json.Unmarshal(b, &stats)
+	if stats["policy"] != "drop-oldest" {
+		t.Errorf("Unexpected %s", b)
+	}
+}
+
+func TestClientStats(t *testing.T) {
+
+	errs := make(chan error, 4)
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), errs)
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.WsServer.BufferSize = 2
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	// Neither client has a writer draining its queue
+	slow := newStreamClient(rest.WsServer, "slow", straumur.Query{}, nil)
+	slow.policy = PolicyDropNewest
+	dead := newStreamClient(rest.WsServer, "dead", straumur.Query{}, nil)
+	rest.WsServer.Add(slow)
+	rest.WsServer.Add(dead)
+	for i := 1; i <= 4; i++ {
+		rest.WsServer.Broadcast(&straumur.Event{ID: i, Key: "stats"})
+	}
+
+	r, err := http.Get(server.URL + "/api/clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := []ClientStats{}
+	json.NewDecoder(r.Body).Decode(&stats)
+	r.Body.Close()
+	byId := map[string]ClientStats{}
+	for _, s := range stats {
+		byId[s.Id] = s
+	}
+	if s := byId["slow"]; s.Queued != 2 || s.Size != 2 || s.Dropped != 2 || s.Sent != 0 || s.Policy != PolicyDropNewest {
+		t.Errorf("Unexpected stats for the slow client %+v", s)
+	}
+	if s := byId["dead"]; s.Queued != 2 || s.Dropped != 2 || s.Policy != PolicyDisconnect {
+		t.Errorf("Unexpected stats for the dead client %+v", s)
+	}
+
+	// The disconnected client is closed once, its handler then removes it
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the disconnect to be reported")
+	}
+	rest.WsServer.Broadcast(&straumur.Event{ID: 5, Key: "stats"})
+	rest.WsServer.Stats()
+	if len(errs) != 0 {
+		t.Errorf("Expected a single disconnect, got %v", <-errs)
+	}
+	select {
+	case <-dead.closed:
+	default:
+		t.Fatalf("Expected the dead client to be closed")
+	}
+	if dead.closeReason != "slow consumer" {
+		t.Errorf("Unexpected close reason %q", dead.closeReason)
+	}
+	select {
+	case <-slow.closed:
+		t.Errorf("Expected the slow client to stay connected")
+	default:
+	}
+}
@@ -0,0 +1,210 @@
+package restservice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/straumur/straumur"
+	"io"
+	"mime"
+	"net/http"
+)
+
+const (
+	MaxBulkEvents = 10000
+	MaxBulkBytes  = 64 << 20
+	maxBulkLine   = 1 << 20
+	ndjsonType    = "application/x-ndjson"
+	bulkAccepted  = "accepted"
+	bulkRejected  = "rejected"
+)
+
+var (
+	ErrBulkTooLarge = errors.New("Bulk request too large")
+	ErrBulkNotArray = errors.New("Bulk body must be a JSON array")
+	ErrEmptyLine    = errors.New("Empty line")
+)
+
+// Outcome of a single event in a bulk request, Line is the 1-based
+// position of the event in the array or NDJSON stream
+type BulkResult struct {
+	Line   int    `json:"line"`
+	Status string `json:"status"`
+	Code   string `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Problems with the payload when it fails schema validation
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// Collects accepted events and per line results
+type bulkBatch struct {
+	principal *Principal
+	schemas   *SchemaRegistry
+	events    []*straumur.Event
+	results   []BulkResult
+}
+
+func (b *bulkBatch) reject(err error) {
+	line := len(b.results) + 1
+	code := statusErrorCode(err, http.StatusBadRequest)
+	result := BulkResult{Line: line, Status: bulkRejected, Code: code, Error: err.Error()}
+	if v, ok := err.(*ValidationError); ok {
+		result.Fields = v.Fields
+	}
+	b.results = append(b.results, result)
+}
+
+// Validates a raw event and records the outcome, fails once the
+// batch is full
+func (b *bulkBatch) add(raw []byte) error {
+
+	if len(b.results) >= MaxBulkEvents {
+		return ErrBulkTooLarge
+	}
+
+	e, err := parseBulkEvent(raw)
+	if err != nil {
+		b.reject(err)
+		return nil
+	}
+	if err := b.schemas.Validate(e); err != nil {
+		b.reject(err)
+		return nil
+	}
+	if err := b.principal.CheckWrite(e); err != nil {
+		b.reject(err)
+		return nil
+	}
+
+	line := len(b.results) + 1
+	b.events = append(b.events, e)
+	b.results = append(b.results, BulkResult{Line: line, Status: bulkAccepted})
+	return nil
+}
+
+// Decodes a single event the same way parseEvent does, bulk
+// ingestion only creates new events
+func parseBulkEvent(raw []byte) (*straumur.Event, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, ErrEmptyLine
+	}
+	var e straumur.Event
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, err
+	}
+	if e.ID != 0 {
+		return nil, ErrSaveExisting
+	}
+	if err := checkKey(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Reads newline delimited events. Blank lines are rejected so results
+// keep the line numbers of the stream, except at the end of it.
+func readNDJSON(body io.Reader, b *bulkBatch) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxBulkLine)
+	blank := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			blank++
+			continue
+		}
+		for ; blank > 0; blank-- {
+			if err := b.add(nil); err != nil {
+				return err
+			}
+		}
+		if err := b.add(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Reads a JSON array of events, elements are decoded one at a time
+// so a single invalid event doesn't reject the whole array
+func readJSONArray(body io.Reader, b *bulkBatch) error {
+	dec := json.NewDecoder(body)
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != '[' {
+		return ErrBulkNotArray
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if bulkTooLarge(err) {
+				return err
+			}
+			// Syntax errors leave the decoder unusable
+			b.reject(err)
+			return nil
+		}
+		if err := b.add(raw); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
+// Reports whether err means the request exceeds MaxBulkEvents or
+// MaxBulkBytes
+func bulkTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return err == ErrBulkTooLarge || errors.As(err, &tooLarge)
+}
+
+// POST: /api/bulk
+// Accepts a JSON array or an application/x-ndjson stream of events.
+// Requests with more than MaxBulkEvents events or MaxBulkBytes bytes
+// are rejected as a whole with 413.
+func (r *RESTService) bulkHandler(w http.ResponseWriter, req *http.Request) (error, int) {
+
+	defer req.Body.Close()
+	body := http.MaxBytesReader(w, req.Body, MaxBulkBytes)
+
+	var err error
+	b := &bulkBatch{principal: PrincipalFrom(req), schemas: r.Schemas}
+
+	mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mt == ndjsonType {
+		err = readNDJSON(body, b)
+	} else {
+		err = readJSONArray(body, b)
+	}
+	if bulkTooLarge(err) {
+		return ErrBulkTooLarge, http.StatusRequestEntityTooLarge
+	}
+	if err != nil && len(b.results) == 0 {
+		return err, http.StatusBadRequest
+	}
+	if err != nil {
+		b.reject(err)
+	}
+
+	for _, e := range b.events {
+		r.stampEvent(req, e)
+		r.traceEvent(req, e)
+	}
+	if len(b.events) > 0 {
+		if err := r.publish(b.events...); err != nil {
+			return unavailable(w, err)
+		}
+	}
+
+	logFor(req).Infof("Bulk request accepted %d of %d events", len(b.events), len(b.results))
+	r.metrics.bulkSaved(b.results)
+
+	w.WriteHeader(http.StatusAccepted)
+	enc := json.NewEncoder(w)
+	enc.Encode(b.results)
+	return nil, http.StatusAccepted
+}
@@ -0,0 +1,105 @@
+package restservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadBulk(t *testing.T) {
+
+	tests := []struct {
+		Body     string
+		NDJSON   bool
+		Statuses []string
+	}{{
+		Body:     `[{"key": "a"}, {"key": 1}, {"id": 3, "key": "c"}, {"key": "d"}]`,
+		Statuses: []string{bulkAccepted, bulkRejected, bulkRejected, bulkAccepted},
+	}, {
+		Body:     "{\"key\": \"a\"}\nnot json\n{\"key\": \"c\"}\n",
+		NDJSON:   true,
+		Statuses: []string{bulkAccepted, bulkRejected, bulkAccepted},
+	}, {
+		// Results keep the line numbers of the stream
+		Body:     "{\"key\": \"a\"}\n\n{\"key\": \"c\"}\n\n",
+		NDJSON:   true,
+		Statuses: []string{bulkAccepted, bulkRejected, bulkAccepted},
+	}, {
+		Body:     `[{"key": "a"}, {"key": ]`,
+		Statuses: []string{bulkAccepted, bulkRejected},
+	}}
+
+	for _, test := range tests {
+		b := &bulkBatch{}
+		var err error
+		if test.NDJSON {
+			err = readNDJSON(strings.NewReader(test.Body), b)
+		} else {
+			err = readJSONArray(strings.NewReader(test.Body), b)
+		}
+		if err != nil {
+			t.Errorf("Unexpected error %v for %s", err, test.Body)
+		}
+		if len(b.results) != len(test.Statuses) {
+			t.Fatalf("Expected %d results, got %+v", len(test.Statuses), b.results)
+		}
+		for i, r := range b.results {
+			if r.Line != i+1 || r.Status != test.Statuses[i] {
+				t.Errorf("Line %d: expected %s, got %+v", i+1, test.Statuses[i], r)
+			}
+		}
+	}
+
+	if err := readJSONArray(strings.NewReader(`{"key": "a"}`), &bulkBatch{}); err != ErrBulkNotArray {
+		t.Errorf("Expected ErrBulkNotArray for a non-array body, got %v", err)
+	}
+
+	b := &bulkBatch{}
+	body := strings.Repeat("{\"key\": \"a\"}\n", MaxBulkEvents+1)
+	if err := readNDJSON(strings.NewReader(body), b); err != ErrBulkTooLarge || len(b.results) != MaxBulkEvents {
+		t.Errorf("Expected reading to stop at %d events, got %v after %d", MaxBulkEvents, err, len(b.results))
+	}
+}
+
+func TestPostBulk(t *testing.T) {
+	once.Do(startServer)
+
+	body := "{\"key\": \"myapp.bulk\", \"entities\": [\"ns/bulk\"]}\n{\"id\": 5}\n"
+	url := fmt.Sprintf("http://%s/bulk", serverAddr)
+	req, err := http.NewRequest("POST", url, bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", ndjsonType)
+	r, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusAccepted {
+		t.Fatalf("Status code expected %d, got %d", http.StatusAccepted, r.StatusCode)
+	}
+
+	results := []BulkResult{}
+	if err := json.NewDecoder(r.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Status != bulkAccepted || results[1].Error != ErrSaveExisting.Error() {
+		t.Errorf("Unexpected results %+v", results)
+	}
+	body = strings.Repeat("{\"key\": \"myapp.bulk\"}\n", MaxBulkEvents+1)
+	req, _ = http.NewRequest("POST", url, strings.NewReader(body))
+	req.Header.Set("Content-Type", ndjsonType)
+	tooLarge, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tooLarge.Body.Close()
+	if tooLarge.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected %d, got %d", http.StatusRequestEntityTooLarge, tooLarge.StatusCode)
+	}
+}
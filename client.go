@@ -2,19 +2,42 @@ package restservice
 
 import (
 	"code.google.com/p/go.net/websocket"
-	"fmt"
+	"encoding/json"
 	"github.com/straumur/straumur"
-	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const replyTimeout = 5 * time.Second
+
 //Represents a connected websocket client
 type Client struct {
-	Id     string
-	ws     *websocket.Conn
-	server *WebSocketServer
-	ch     chan *straumur.Event
-	doneCh chan bool
-	query  straumur.Query
+	// Accessed atomically, kept first for 64-bit alignment
+	sent    uint64
+	dropped uint64
+	Id      string
+	ws      *websocket.Conn
+	server  *WebSocketServer
+	ch      chan interface{}
+	doneCh  chan bool
+	policy  SlowConsumerPolicy
+	mu      sync.Mutex
+	query   straumur.Query
+	// Heartbeat settings copied from the server
+	pingInterval time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	activity     *activity
+	closeReason  string
+	closed       chan struct{} // closed along with closeReason being set
+	replaying    int32         // set while a stream client replays, accessed atomically
+	principal    *Principal    // nil when authentication is disabled
+	limiter      *RateLimiter
+	rateKey      string
+	// Named subscriptions, once a client subscribes query is ignored
+	subscriptions map[string]straumur.Query
 }
 
 func NewClient(ws *websocket.Conn, server *WebSocketServer, uuid string) *Client {
@@ -23,46 +46,167 @@ func NewClient(ws *websocket.Conn, server *WebSocketServer, uuid string) *Client
 		panic("ws cannot be nil")
 	}
 
-	ch := make(chan *straumur.Event)
-	doneCh := make(chan bool)
-	query := straumur.Query{}
-	return &Client{uuid, ws, server, ch, doneCh, query}
+	c := &Client{
+		Id:            uuid,
+		ws:            ws,
+		server:        server,
+		ch:            make(chan interface{}, server.BufferSize),
+		doneCh:        make(chan bool),
+		closed:        make(chan struct{}),
+		policy:        server.Policy,
+		pingInterval:  server.PingInterval,
+		writeTimeout:  server.WriteTimeout,
+		idleTimeout:   server.IdleTimeout,
+		activity:      activityOf(ws),
+		principal:     principalOf(ws),
+		subscriptions: make(map[string]straumur.Query),
+	}
+	if c.limiter = server.SubscribeLimiter; c.limiter != nil && ws.Request() != nil {
+		c.rateKey = c.limiter.KeyFunc(ws.Request())
+	}
+	return c
 }
 
 func (c *Client) Conn() *websocket.Conn {
 	return c.ws
 }
 
+// Replaces the filter used when the client has no subscriptions
+func (c *Client) setQuery(q straumur.Query) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.query = q
+}
+
+// Returns the message to send for event, target is the event to match
+// against. Clients with subscriptions receive the event wrapped in a
+// Message tagged with the ids of the subscriptions it matched.
+func (c *Client) match(event *straumur.Event, target straumur.Event) (interface{}, bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.subscriptions) == 0 {
+		return event, c.query.Match(target)
+	}
+
+	ids := []string{}
+	for id, q := range c.subscriptions {
+		if q.Match(target) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, false
+	}
+	sort.Strings(ids)
+	return &Message{Type: MessageEvent, Subscriptions: ids, Event: event}, true
+}
+
 func (c *Client) Write(e *straumur.Event) {
+	c.send(e)
+}
+
+// Sends a reply to a command, waiting for the writer to pick it up
+func (c *Client) reply(msg *Message) {
 	select {
-	case c.ch <- e:
-	default:
-		c.server.Del(c)
-		err := fmt.Errorf("client %s is disconnected.", c.Id)
-		c.server.Err(err)
+	case c.ch <- msg:
+	case <-time.After(replyTimeout):
+		logger.Warningf("Dropped reply %s to client %s", msg.Type, c.Id)
+	}
+}
+
+// Registers the subscription in cmd and returns the reply
+func (c *Client) subscribe(cmd *Command) *Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addSubscription(cmd)
+}
+
+func (c *Client) addSubscription(cmd *Command) *Message {
+	if cmd.Id == "" {
+		return errorMessage(cmd.Id, ErrMissingSubscription)
+	}
+	if cmd.Query == nil {
+		return errorMessage(cmd.Id, ErrMissingQuery)
+	}
+	if err := c.principal.CheckQuery(cmd.Query); err != nil {
+		return errorMessage(cmd.Id, err)
+	}
+	_, exists := c.subscriptions[cmd.Id]
+	if !exists && len(c.subscriptions) >= MaxSubscriptions {
+		return errorMessage(cmd.Id, ErrTooManySubscription)
+	}
+	c.subscriptions[cmd.Id] = *cmd.Query
+	return &Message{Type: MessageSubscribed, Id: cmd.Id}
+}
+
+// Executes a command and returns the reply
+func (c *Client) handle(cmd *Command) *Message {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch cmd.Command {
+
+	case CommandSubscribe:
+		return c.addSubscription(cmd)
+
+	case CommandUnsubscribe:
+		if _, ok := c.subscriptions[cmd.Id]; !ok {
+			return errorMessage(cmd.Id, ErrUnknownSubscription)
+		}
+		delete(c.subscriptions, cmd.Id)
+		return &Message{Type: MessageUnsubscribed, Id: cmd.Id}
+
+	case CommandList:
+		queries := make(map[string]straumur.Query)
+		for id, q := range c.subscriptions {
+			queries[id] = q
+		}
+		return &Message{Type: MessageSubscriptions, Queries: queries}
 	}
+
+	return errorMessage(cmd.Id, ErrUnknownCommand)
 }
 
+// Disconnects the client
 func (c *Client) Done() {
-	c.doneCh <- true
+	c.close("done")
 }
 
 func (c *Client) Listen() {
+	c.extendReadDeadline()
 	go c.listenWrite()
 	c.listenRead()
 }
 
 func (c *Client) listenWrite() {
 
+	var ping <-chan time.Time
+	if c.pingInterval > 0 {
+		ticker := time.NewTicker(c.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
 	for {
 		select {
 
-		case event := <-c.ch:
-			err := websocket.JSON.Send(c.ws, event)
+		case msg := <-c.ch:
+			if c.writeTimeout > 0 {
+				c.ws.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			}
+			err := websocket.JSON.Send(c.ws, msg)
 			if err != nil {
-				c.server.Err(err)
+				c.close("write failed: " + err.Error())
+			} else {
+				atomic.AddUint64(&c.sent, 1)
 			}
 
+		case <-ping:
+			c.heartbeat()
+
 		case <-c.doneCh:
 			c.server.Del(c)
 			c.doneCh <- true
@@ -71,27 +215,50 @@ func (c *Client) listenWrite() {
 	}
 }
 
+// Moves the read deadline IdleTimeout past now
+func (c *Client) extendReadDeadline() {
+	if c.idleTimeout > 0 {
+		c.ws.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
+}
+
 func (c *Client) listenRead() {
 
 	for {
-		select {
-
-		case <-c.doneCh:
-			c.server.Del(c)
+		// read data from websocket connection
+		var raw json.RawMessage
+		err := websocket.JSON.Receive(c.ws, &raw)
+		if err != nil && isDisconnect(err) {
+			c.close("read failed: " + err.Error())
+			c.mu.Lock()
+			reason := c.closeReason
+			c.mu.Unlock()
+			logger.Infof("Removing client %s: %s", c.Id, reason)
+			// Stop the writer and wait for it to remove the client
 			c.doneCh <- true
+			<-c.doneCh
 			return
+		}
 
-		// read data from websocket connection
-		default:
-			var q straumur.Query
-			err := websocket.JSON.Receive(c.ws, &q)
-			if err == io.EOF {
-				c.doneCh <- true
-			} else if err != nil {
-				c.server.Err(err)
-			} else {
-				c.query = q
-			}
+		// A frame was read, with or without pings the client is not idle
+		c.extendReadDeadline()
+		if err != nil {
+			c.server.Err(err)
+			continue
+		}
+
+		c.activity.touch()
+		cmd, q, err := parseCommand(raw)
+		if err != nil {
+			c.reply(errorMessage("", err))
+		} else if cmd != nil && cmd.Command == CommandSubscribe && !c.allowSubscribe() {
+			c.reply(errorMessage(cmd.Id, ErrRateLimited))
+		} else if cmd != nil && cmd.Command == CommandSubscribe && cmd.Since != nil {
+			c.server.Replay(c, cmd)
+		} else if cmd != nil {
+			c.reply(c.handle(cmd))
+		} else {
+			c.setQuery(*q)
 		}
 	}
 }
@@ -0,0 +1,206 @@
+package restservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nu7hatch/gouuid"
+	"net/http"
+	"strings"
+)
+
+const requestIdHeader = "X-Request-Id"
+
+// Machine readable error codes, clients should switch on these rather
+// than on messages
+const (
+	CodeSaveExisting         = "save_existing"
+	CodeUpdateNonExisting    = "update_non_existing"
+	CodeMissingType          = "missing_type"
+	CodeInvalidEntity        = "invalid_entity"
+	CodeNotFound             = "not_found"
+	CodeDeleted              = "deleted"
+	CodeInvalidCursor        = "invalid_cursor"
+	CodeInvalidLimit         = "invalid_limit"
+	CodeSaveTimeout          = "save_timeout"
+	CodeBulkTooLarge         = "bulk_too_large"
+	CodeBulkNotArray         = "bulk_not_array"
+	CodeEmptyLine            = "empty_line"
+	CodeStreamingUnsupported = "streaming_unsupported"
+	CodeInvalidLastEventId   = "invalid_last_event_id"
+	CodeUnknownCommand       = "unknown_command"
+	CodeMissingSubscription  = "missing_subscription"
+	CodeMissingQuery         = "missing_query"
+	CodeUnknownSubscription  = "unknown_subscription"
+	CodeTooManySubscriptions = "too_many_subscriptions"
+	CodeUnauthorized         = "unauthorized"
+	CodeForbidden            = "forbidden"
+	CodeOriginForbidden      = "origin_forbidden"
+	CodeEntityForbidden      = "entity_forbidden"
+	CodeEntityRequired       = "entity_required"
+	CodeUnknownTenant        = "unknown_tenant"
+	CodeMissingTenant        = "missing_tenant"
+	CodeInvalidToken         = "invalid_token"
+	CodeExpiredToken         = "expired_token"
+	CodeTokensDisabled       = "tokens_disabled"
+	CodeOriginNotAllowed     = "origin_not_allowed"
+	CodeShuttingDown         = "shutting_down"
+	CodeRateLimited          = "rate_limited"
+	CodeQueueFull            = "queue_full"
+	CodeBadIdempotencyKey    = "invalid_idempotency_key"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeRequestInProgress    = "request_in_progress"
+	CodePreconditionFailed   = "precondition_failed"
+	CodeUnsupportedPatch     = "unsupported_patch"
+	CodePatchTestFailed      = "patch_test_failed"
+	CodeSchemaNotFound       = "schema_not_found"
+	CodeReservedKey          = "reserved_key"
+	CodeInvalidJSON          = "invalid_json"
+	CodeValidationFailed     = "validation_failed"
+	CodeBadRequest           = "bad_request"
+	CodeInternal             = "internal_error"
+)
+
+var errorCodes = map[error]string{
+	ErrSaveExisting:         CodeSaveExisting,
+	ErrUpdateNonExisting:    CodeUpdateNonExisting,
+	ErrMissingType:          CodeMissingType,
+	ErrInvalidEntity:        CodeInvalidEntity,
+	ErrNotFound:             CodeNotFound,
+	ErrDeleted:              CodeDeleted,
+	ErrInvalidCursor:        CodeInvalidCursor,
+	ErrInvalidLimit:         CodeInvalidLimit,
+	ErrSaveTimeout:          CodeSaveTimeout,
+	ErrBulkTooLarge:         CodeBulkTooLarge,
+	ErrBulkNotArray:         CodeBulkNotArray,
+	ErrEmptyLine:            CodeEmptyLine,
+	ErrStreamingUnsupported: CodeStreamingUnsupported,
+	ErrInvalidLastEventId:   CodeInvalidLastEventId,
+	ErrUnknownCommand:       CodeUnknownCommand,
+	ErrMissingSubscription:  CodeMissingSubscription,
+	ErrMissingQuery:         CodeMissingQuery,
+	ErrUnknownSubscription:  CodeUnknownSubscription,
+	ErrTooManySubscription:  CodeTooManySubscriptions,
+	ErrUnauthorized:         CodeUnauthorized,
+	ErrForbidden:            CodeForbidden,
+	ErrOriginForbidden:      CodeOriginForbidden,
+	ErrEntityForbidden:      CodeEntityForbidden,
+	ErrEntityRequired:       CodeEntityRequired,
+	ErrUnknownTenant:        CodeUnknownTenant,
+	ErrMissingTenant:        CodeMissingTenant,
+	ErrInvalidToken:         CodeInvalidToken,
+	ErrExpiredToken:         CodeExpiredToken,
+	ErrTokensDisabled:       CodeTokensDisabled,
+	ErrOriginNotAllowed:     CodeOriginNotAllowed,
+	ErrShuttingDown:         CodeShuttingDown,
+	ErrRateLimited:          CodeRateLimited,
+	ErrQueueFull:            CodeQueueFull,
+	ErrBadIdempotencyKey:    CodeBadIdempotencyKey,
+	ErrIdempotencyKeyReused: CodeIdempotencyKeyReused,
+	ErrRequestInProgress:    CodeRequestInProgress,
+	ErrPreconditionFailed:   CodePreconditionFailed,
+	ErrUnsupportedPatch:     CodeUnsupportedPatch,
+	ErrPatchTestFailed:      CodePatchTestFailed,
+	ErrSchemaNotFound:       CodeSchemaNotFound,
+	ErrReservedKey:          CodeReservedKey,
+}
+
+// Problem with a single field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error carrying details about the offending fields
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := []string{}
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Field+": "+f.Message)
+	}
+	return "Validation failed: " + strings.Join(msgs, ", ")
+}
+
+// Body of every error response
+type ErrorResponse struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	RequestId string       `json:"request_id,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
+}
+
+// Returns the code of err, unknown errors get a generic code
+func errorCode(err error) string {
+	if code, ok := errorCodes[err]; ok {
+		return code
+	}
+	switch err.(type) {
+	case *ValidationError, *json.UnmarshalTypeError:
+		return CodeValidationFailed
+	case *json.SyntaxError:
+		return CodeInvalidJSON
+	}
+	return ""
+}
+
+// Returns the code for err, falling back on one derived from status
+func statusErrorCode(err error, status int) string {
+	if code := errorCode(err); code != "" {
+		return code
+	}
+	switch {
+	case status == http.StatusNotFound:
+		return CodeNotFound
+	case status >= 500:
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
+
+// Builds the error response for err
+func newErrorResponse(err error, status int, requestId string) ErrorResponse {
+
+	resp := ErrorResponse{
+		Code:      statusErrorCode(err, status),
+		Message:   err.Error(),
+		RequestId: requestId,
+	}
+
+	switch e := err.(type) {
+	case *ValidationError:
+		resp.Fields = e.Fields
+	case *json.UnmarshalTypeError:
+		resp.Fields = []FieldError{{
+			e.Field,
+			fmt.Sprintf("expected %s, got %s", e.Type, e.Value),
+		}}
+	}
+	return resp
+}
+
+// Returns the id of the request, one is assigned if the client
+// didn't send a valid one
+func requestId(req *http.Request) string {
+	id := req.Header.Get(requestIdHeader)
+	if !validRequestId(id) {
+		u4, err := uuid.NewV4()
+		if err != nil {
+			logger.Errorf("%v", err)
+			return ""
+		}
+		id = u4.String()
+		req.Header.Set(requestIdHeader, id)
+	}
+	return id
+}
+
+// Writes err as a JSON error response
+func writeError(w http.ResponseWriter, req *http.Request, err error, status int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.Encode(newErrorResponse(err, status, req.Header.Get(requestIdHeader)))
+}
@@ -0,0 +1,63 @@
+package restservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/straumur/straumur"
+	"net/http"
+	"testing"
+)
+
+func TestErrorResponse(t *testing.T) {
+
+	tests := []struct {
+		Err    error
+		Status int
+		Code   string
+	}{
+		{ErrSaveExisting, http.StatusBadRequest, CodeSaveExisting},
+		{ErrUpdateNonExisting, http.StatusBadRequest, CodeUpdateNonExisting},
+		{ErrMissingType, http.StatusBadRequest, CodeMissingType},
+		{ErrInvalidEntity, http.StatusBadRequest, CodeInvalidEntity},
+		{errors.New("boom"), http.StatusInternalServerError, CodeInternal},
+		{errors.New("nope"), http.StatusBadRequest, CodeBadRequest},
+	}
+
+	for _, test := range tests {
+		resp := newErrorResponse(test.Err, test.Status, "req-1")
+		if resp.Code != test.Code || resp.Message != test.Err.Error() || resp.RequestId != "req-1" {
+			t.Errorf("Unexpected response %+v for %v", resp, test.Err)
+		}
+	}
+
+	var e straumur.Event
+	err := json.Unmarshal([]byte(`{"importance": "high"}`), &e)
+	resp := newErrorResponse(err, http.StatusBadRequest, "")
+	if resp.Code != CodeValidationFailed || len(resp.Fields) != 1 || resp.Fields[0].Field != "importance" {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+}
+
+func TestErrorResponseBody(t *testing.T) {
+	once.Do(startServer)
+
+	e := straumur.Event{Key: "myapp.user.update"}
+	r := putJSON(t, fmt.Sprintf("http://%s/1/", serverAddr), &e)
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Status code expected %d, got %d", http.StatusBadRequest, r.StatusCode)
+	}
+
+	var resp ErrorResponse
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != CodeUpdateNonExisting {
+		t.Errorf("Code expected %s, got %+v", CodeUpdateNonExisting, resp)
+	}
+	if resp.RequestId == "" || resp.RequestId != r.Header.Get(requestIdHeader) {
+		t.Errorf("Request id %q doesn't match header %q", resp.RequestId, r.Header.Get(requestIdHeader))
+	}
+}
@@ -0,0 +1,115 @@
+package restservice
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/straumur/straumur"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrPreconditionFailed = errors.New("Event has been modified")
+)
+
+// Returns a strong entity tag for the stored content of e
+func eventETag(e *straumur.Event) string {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Reports whether etag is in the If-Match or If-None-Match value
+// header, weak compares W/"x" equal to "x" as If-None-Match does
+func etagMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluates If-None-Match for a GET of e, writes 304 and returns true
+// when the client has the current version
+func notModified(w http.ResponseWriter, req *http.Request, e *straumur.Event) bool {
+	etag := eventETag(e)
+	w.Header().Set("ETag", etag)
+	match := req.Header.Get("If-None-Match")
+	if match == "" || !etagMatches(match, etag, true) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// Evaluates If-Match for an update against the stored event
+func (r *RESTService) checkIfMatch(req *http.Request, id int) (error, int) {
+	match := req.Header.Get("If-Match")
+	if match == "" {
+		return nil, http.StatusOK
+	}
+	stored, err := r.backend(req).GetById(id)
+	if err != nil {
+		return err, http.StatusInternalServerError
+	}
+	if stored == nil || !etagMatches(match, eventETag(stored), false) {
+		return ErrPreconditionFailed, http.StatusPreconditionFailed
+	}
+	return nil, http.StatusOK
+}
+
+// Serialises conditional updates and patches of the same event. They
+// are saved synchronously under the lock, so the next one is checked
+// against the stored result.
+type updateLocks struct {
+	mu    sync.Mutex
+	locks map[int]*idLock
+}
+
+type idLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Locks id and returns the unlock function
+func (l *updateLocks) lock(id int) func() {
+
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[int]*idLock)
+	}
+	m, ok := l.locks[id]
+	if !ok {
+		m = &idLock{}
+		l.locks[id] = m
+	}
+	m.refs++
+	l.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if m.refs--; m.refs == 0 {
+			delete(l.locks, id)
+		}
+	}
+}
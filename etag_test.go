@@ -0,0 +1,173 @@
+package restservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestETagMatches(t *testing.T) {
+
+	etag := `"abc"`
+	for _, c := range []struct {
+		header string
+		weak   bool
+		match  bool
+	}{
+		{`"abc"`, false, true},
+		{`"xyz", "abc"`, false, true},
+		{`*`, false, true},
+		{`W/"abc"`, false, false},
+		{`W/"abc"`, true, true},
+		{`"xyz"`, true, false},
+	} {
+		if etagMatches(c.header, etag, c.weak) != c.match {
+			t.Errorf("Expected %v for %s, weak %v", c.match, c.header, c.weak)
+		}
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+
+	d := straumur.NewLocalMemoryStore()
+	d.Save(&straumur.Event{Key: "etag", Origin: "myapp"})
+
+	rest := NewRESTService(d, make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	go func() {
+		for e := range rest.Updates() {
+			rest.Ack(e, d.Save(e))
+		}
+	}()
+
+	do := func(method, path, header, value string, body interface{}) *http.Response {
+		buf, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, server.URL+path, bytes.NewReader(buf))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r
+	}
+
+	r := do("GET", "/api/1/", "", "", nil)
+	etag := r.Header.Get("ETag")
+	if r.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("Expected an ETag, got %d %v", r.StatusCode, r.Header)
+	}
+	if r := do("GET", "/api/1/", "If-None-Match", etag, nil); r.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected %d, got %d", http.StatusNotModified, r.StatusCode)
+	}
+
+	update := &straumur.Event{ID: 1, Key: "etag.updated", Origin: "myapp"}
+	if r := do("PUT", "/api/1/?sync=true", "If-Match", `"stale"`, update); r.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected %d, got %d", http.StatusPreconditionFailed, r.StatusCode)
+	}
+
+	r = do("PUT", "/api/1/?sync=true", "If-Match", etag, update)
+	if r.StatusCode != http.StatusOK || r.Header.Get("ETag") == etag {
+		t.Fatalf("Expected the update to pass with a new ETag, got %d %v", r.StatusCode, r.Header)
+	}
+	if r := do("GET", "/api/1/", "If-None-Match", etag, nil); r.StatusCode != http.StatusOK {
+		t.Errorf("Expected the old ETag to be stale, got %d", r.StatusCode)
+	}
+
+	// The other operator still holds the old ETag
+	update.Key = "etag.overwritten"
+	if r := do("PUT", "/api/1/", "If-Match", etag, update); r.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected %d, got %d", http.StatusPreconditionFailed, r.StatusCode)
+	}
+}
+
+func TestConcurrentConditionalUpdates(t *testing.T) {
+
+	d := straumur.NewLocalMemoryStore()
+	d.Save(&straumur.Event{Key: "etag", Origin: "myapp"})
+
+	rest := NewRESTService(d, make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	go func() {
+		for e := range rest.Updates() {
+			// A slow backend, the second update must wait for it
+			time.Sleep(20 * time.Millisecond)
+			rest.Ack(e, d.Save(e))
+		}
+	}()
+
+	r, err := http.Get(server.URL + "/api/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	etag := r.Header.Get("ETag")
+
+	statuses := make(chan int, 2)
+	for _, key := range []string{"etag.first", "etag.second"} {
+		go func(key string) {
+			buf, _ := json.Marshal(&straumur.Event{ID: 1, Key: key, Origin: "myapp"})
+			req, _ := http.NewRequest("PUT", server.URL+"/api/1/", bytes.NewReader(buf))
+			req.Header.Set("If-Match", etag)
+			r, err := http.DefaultClient.Do(req)
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			r.Body.Close()
+			statuses <- r.StatusCode
+		}(key)
+	}
+
+	got := map[int]int{}
+	got[<-statuses]++
+	got[<-statuses]++
+	if got[http.StatusOK] != 1 || got[http.StatusPreconditionFailed] != 1 {
+		t.Errorf("Expected one update to win and one to fail, got %v", got)
+	}
+}
+
+func TestConditionalUpdateWithoutAck(t *testing.T) {
+
+	d := straumur.NewLocalMemoryStore()
+	d.Save(&straumur.Event{Key: "etag", Origin: "myapp"})
+
+	rest := NewRESTService(d, make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.SyncTimeout = 50 * time.Millisecond
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	// A consumer that saves without calling Ack
+	go func() {
+		for e := range rest.Updates() {
+			d.Save(e)
+		}
+	}()
+
+	stored, _ := d.GetById(1)
+	buf, _ := json.Marshal(&straumur.Event{ID: 1, Key: "etag.updated", Origin: "myapp"})
+	req, _ := http.NewRequest("PUT", server.URL+"/api/1/", bytes.NewReader(buf))
+	req.Header.Set("If-Match", eventETag(stored))
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusAccepted {
+		t.Errorf("Expected an unconfirmed update to be accepted, got %d", r.StatusCode)
+	}
+}
@@ -2,8 +2,10 @@ package restservice
 
 //TODO: Better use of errchan
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/howbazaar/loggo"
@@ -11,7 +13,9 @@ import (
 	"github.com/straumur/straumur"
 	"io"
 	"net/http"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -20,18 +24,70 @@ var (
 	ErrUpdateNonExisting = errors.New("Update non-existing resource")
 	ErrMissingType       = errors.New("Missing type param")
 	ErrInvalidEntity     = errors.New("Invalid entity")
+	ErrNotFound          = errors.New("Resource not found")
+	ErrDeleted           = errors.New("Resource has been deleted")
 	logger               = loggo.GetLogger("straumur.rest")
 	sessionName          = "straumur"
 	clientVarName        = "client-id"
 )
 
+// Keys of values stored in request contexts
+type contextKey int
+
+const (
+	activityKey contextKey = iota
+	principalKey
+	requestIdKey
+	spanKey
+	lateResponseKey
+	basePathKey
+)
+
 type RESTService struct {
 	Headers     map[string]string
 	Store       sessions.Store
+	Auth        Authenticator // nil disables authentication
+	Tokens      *TokenSigner  // nil disables websocket connect tokens
+	tenant      string        // set by MultiTenantService.Add
 	databackend straumur.DataBackend
 	events      chan *straumur.Event
 	WsServer    *WebSocketServer
+	PageSize    int
+	MaxPageSize int
+	SyncTimeout time.Duration
 	errchan     chan error
+	acks        *ackRegistry
+	queue       *ingestQueue
+	metrics     *metrics
+	tracer      *Tracer
+	idempotency *idempotencyStore
+	updates     updateLocks
+	accessMu    sync.Mutex
+
+	// Browser origins allowed to open websocket connections, empty
+	// allows every origin
+	AllowedOrigins []string
+	// Readiness probe timeout and how long pending events may go
+	// unread before the event feed counts as stalled
+	ProbeTimeout time.Duration
+	StallTimeout time.Duration
+	// Rate limiters by method and route template, see rateLimiter
+	RateLimits map[string]*RateLimiter
+	// Events accepted but not yet read from Updates(), or not yet
+	// acknowledged when a write-ahead log is open
+	QueueSize int
+	// How long Idempotency-Key responses are kept for replay, and how
+	// long the key of a timed out sync save waits for the Ack before
+	// it is released
+	ReplayTTL      time.Duration
+	LateAckTimeout time.Duration
+	// JSON Schemas event payloads are validated against by key
+	Schemas *SchemaRegistry
+	// Receives one JSON line per request, nil disables the access log
+	AccessLog io.Writer
+	// Records the request id of saves, patches and deletes in the
+	// KeyParams of the event, see RequestIdParam
+	StampRequestId bool
 }
 
 // Returns the entity prefix
@@ -48,7 +104,7 @@ func getEntity(req *http.Request) (string, error) {
 // Parses a Query from the request
 func getQuery(req *http.Request) (*straumur.Query, error) {
 	req.ParseForm()
-	return straumur.QueryFromValues(req.Form)
+	return straumur.QueryFromValues(withoutPaging(req.Form))
 }
 
 // Parses an event from the post body
@@ -67,17 +123,17 @@ func (r *RESTService) AddSessionIdHeader(f func(http.ResponseWriter, *http.Reque
 
 		session, err := r.Store.Get(req, sessionName)
 		if err != nil {
-			logger.Errorf("%v", err)
+			logFor(req).Errorf("%v", err)
 		}
 
 		cidi, ok := session.Values[clientVarName]
 		cid := ""
 
 		if !ok {
-			logger.Infof("New session")
+			logFor(req).Infof("New session")
 			u4, err := uuid.NewV4()
 			if err != nil {
-				logger.Errorf("%v", err)
+				logFor(req).Errorf("%v", err)
 			}
 			cid = u4.String()
 			session.Values[clientVarName] = cid
@@ -86,13 +142,14 @@ func (r *RESTService) AddSessionIdHeader(f func(http.ResponseWriter, *http.Reque
 			cid = cidi.(string)
 		}
 
-		req.Header.Add("X-User-Id", cid)
+		req.Header.Set("X-User-Id", cid)
 		f(w, req)
 	}
 
 }
 
-// Wraps http.HandlerFunc, adds error response and frequently used headers
+// Wraps http.HandlerFunc, adds JSON error responses, a request id and
+// frequently used headers
 func (r *RESTService) Middleware(f func(http.ResponseWriter, *http.Request) (error, int)) http.HandlerFunc {
 
 	v := func(w http.ResponseWriter, req *http.Request) {
@@ -100,16 +157,30 @@ func (r *RESTService) Middleware(f func(http.ResponseWriter, *http.Request) (err
 		for k, v := range r.Headers {
 			w.Header().Set(k, v)
 		}
+		w.Header().Set(requestIdHeader, RequestIdFrom(req))
 
 		t := time.Now()
-		err, status := f(w, req)
-
-		logger.Infof("Processed request: %s:%s in %f seconds", req.Method, req.URL, time.Now().Sub(t).Seconds())
+		req, span := r.tracer.startRequest(req, "HTTP "+req.Method+" "+routeOf(req))
+		if span != nil {
+			w.Header().Set(traceparentHeader, span.Context().Traceparent())
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		err, status := f(rec, req)
 
+		span.SetError(err)
 		if err != nil {
-			logger.Warningf("Error - [%s]%s, status: %d", req.Method, req.URL, status)
-			http.Error(w, err.Error(), status)
+			logFor(req).Warningf("Error - [%s]%s, status: %d: %v", req.Method, req.URL, status, err)
+			writeError(rec, req, err, status)
+		}
+
+		elapsed := time.Now().Sub(t)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
 		}
+		span.SetAttribute("http.status_code", rec.status)
+		span.Finish()
+		r.logAccess(req, rec, t, elapsed)
+		r.metrics.observeRequest(routeOf(req), req.Method, rec.status, elapsed)
 	}
 
 	return r.AddSessionIdHeader(v)
@@ -126,17 +197,20 @@ func (r *RESTService) entityHandler(w http.ResponseWriter, req *http.Request) (e
 		return err, http.StatusInternalServerError
 	}
 	q.Entities = append(q.Entities, e)
-	events, err := r.databackend.Query(*q)
+	p := PrincipalFrom(req)
+	if err := p.CheckQuery(q); err != nil {
+		return err, http.StatusForbidden
+	}
+	err, status := r.writePage(w, req, []straumur.Query{*q}, nil)
 	if err != nil {
-		return err, http.StatusInternalServerError
+		return err, status
 	}
-	enc := json.NewEncoder(w)
-	enc.Encode(events)
 	r.WsServer.Filters <- FilterPair{req.Header.Get("X-User-Id"), *q, 1}
 	return nil, http.StatusOK
 }
 
 // GET: /api/id/
+// Sets ETag, If-None-Match is answered with 304
 func (r *RESTService) retrieveHandler(w http.ResponseWriter, req *http.Request) (error, int) {
 
 	vars := mux.Vars(req)
@@ -145,10 +219,19 @@ func (r *RESTService) retrieveHandler(w http.ResponseWriter, req *http.Request)
 	if err != nil {
 		return err, http.StatusBadRequest
 	}
-	event, err := r.databackend.GetById(idAsInt)
+	event, err := r.backend(req).GetById(idAsInt)
 	if err != nil {
 		return err, http.StatusInternalServerError
 	}
+	if event != nil && !PrincipalFrom(req).CanRead(event) {
+		return ErrEntityForbidden, http.StatusForbidden
+	}
+	if event != nil && IsTombstone(event) {
+		return ErrDeleted, http.StatusGone
+	}
+	if event != nil && notModified(w, req, event) {
+		return nil, http.StatusNotModified
+	}
 	enc := json.NewEncoder(w)
 	enc.Encode(event)
 	return nil, http.StatusOK
@@ -156,8 +239,19 @@ func (r *RESTService) retrieveHandler(w http.ResponseWriter, req *http.Request)
 
 // POST: /
 // PUT: /id/
-// Save or update
+// Save or update, with ?sync=true the response waits for the consumer
+// of Updates() to Ack the save and contains the stored event. Updates
+// with If-Match fail with 412 unless it matches the ETag of the
+// stored event, they wait for the Ack so a concurrent update is
+// checked against the result. Without ?sync=true an update that isn't
+// acknowledged within SyncTimeout is answered with 202.
 func (r *RESTService) saveHandler(w http.ResponseWriter, req *http.Request) (error, int) {
+	err, status := r.save(w, req)
+	r.metrics.eventSaved(err, status)
+	return err, status
+}
+
+func (r *RESTService) save(w http.ResponseWriter, req *http.Request) (error, int) {
 
 	vars := mux.Vars(req)
 	id := vars["id"]
@@ -171,15 +265,187 @@ func (r *RESTService) saveHandler(w http.ResponseWriter, req *http.Request) (err
 	if id != "" && e.ID == 0 {
 		return ErrUpdateNonExisting, http.StatusBadRequest
 	}
+	if err := checkKey(&e); err != nil {
+		return err, http.StatusBadRequest
+	}
+	if err := r.Schemas.Validate(&e); err != nil {
+		return err, http.StatusBadRequest
+	}
+	if err, status := r.checkWrite(req, &e); err != nil {
+		return err, status
+	}
+	if id != "" && req.Header.Get("If-Match") != "" {
+		defer r.updates.lock(e.ID)()
+		if err, status := r.checkIfMatch(req, e.ID); err != nil {
+			return err, status
+		}
+		r.stampEvent(req, &e)
+		r.traceEvent(req, &e)
+		return r.syncSave(w, req, &e)
+	}
+	r.stampEvent(req, &e)
+	r.traceEvent(req, &e)
+
+	return r.emit(w, req, &e)
+}
+
+// Sends a new or updated event through the event feed, waiting for
+// the save with ?sync=true
+func (r *RESTService) emit(w http.ResponseWriter, req *http.Request, e *straumur.Event) (error, int) {
+
+	if isSync(req) {
+		return r.syncSave(w, req, e)
+	}
+
+	// The consumer owns e once it is published
+	status := http.StatusAccepted
 	if e.ID == 0 {
-		w.WriteHeader(http.StatusCreated)
-	} else {
+		status = http.StatusCreated
+	}
+	key := e.Key
+
+	if err := r.publish(e); err != nil {
+		return unavailable(w, err)
+	}
+
+	w.WriteHeader(status)
+	logFor(req).Infof("Saved event for key %s", key)
+	return nil, 0
+}
+
+// Checks the caller may write e, updates also require write access to
+// the stored event and may not bring back a deleted one
+func (r *RESTService) checkWrite(req *http.Request, e *straumur.Event) (error, int) {
+
+	p := PrincipalFrom(req)
+	if err := p.CheckWrite(e); err != nil {
+		return err, http.StatusForbidden
+	}
+	if e.ID == 0 {
+		return nil, http.StatusOK
+	}
+
+	stored, err := r.backend(req).GetById(e.ID)
+	if err != nil {
+		return err, http.StatusInternalServerError
+	}
+	if stored == nil {
+		return nil, http.StatusOK
+	}
+	if err := p.CheckWrite(stored); err != nil {
+		return err, http.StatusForbidden
+	}
+	if IsTombstone(stored) {
+		return ErrDeleted, http.StatusGone
+	}
+	return nil, http.StatusOK
+}
+
+// Saves e synchronously and writes the stored event. Conditional
+// updates and patches wait for the Ack without ?sync=true too, for
+// them a timeout means the event was queued but the save is not
+// confirmed and is answered with 202.
+func (r *RESTService) syncSave(w http.ResponseWriter, req *http.Request, e *straumur.Event) (error, int) {
+
+	status := http.StatusOK
+	if e.ID == 0 {
+		status = http.StatusCreated
+	}
+
+	var late func(error)
+	if settle := lateResponseFrom(req); settle != nil {
+		late = func(err error) {
+			if err != nil {
+				settle(err, http.StatusInternalServerError, nil, nil)
+				return
+			}
+			header, body := savedResponse(req, e)
+			settle(nil, status, header, body)
+		}
+	}
+
+	err := r.saveAndWait(e, late)
+	if err == ErrSaveTimeout && !isSync(req) {
+		logFor(req).Warningf("Save of event %d for key %s not acknowledged within %v", e.ID, e.Key, r.SyncTimeout)
 		w.WriteHeader(http.StatusAccepted)
+		return nil, http.StatusAccepted
+	}
+	if err == ErrSaveTimeout {
+		return err, http.StatusGatewayTimeout
+	}
+	if err == ErrShuttingDown || err == ErrQueueFull {
+		return unavailable(w, err)
+	}
+	if err != nil {
+		logFor(req).Errorf("Save failed for key %s: %v", e.Key, err)
+		return err, http.StatusInternalServerError
+	}
+
+	logFor(req).Infof("Saved event %d for key %s", e.ID, e.Key)
+	header, body := savedResponse(req, e)
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+	return nil, status
+}
+
+// Returns the headers and body of the response to a saved event
+func savedResponse(req *http.Request, e *straumur.Event) (http.Header, []byte) {
+	header := make(http.Header)
+	header.Set("Location", fmt.Sprintf("%s/api/%d/", basePath(req), e.ID))
+	header.Set("ETag", eventETag(e))
+	body, _ := json.Marshal(e)
+	return header, append(body, '\n')
+}
+
+// DELETE: /api/id/
+// Emits a tombstone for the event through the event feed, consumers
+// store it over the deleted event and broadcast it to subscribers.
+// Supports ?sync=true like saveHandler.
+func (r *RESTService) deleteHandler(w http.ResponseWriter, req *http.Request) (error, int) {
+
+	vars := mux.Vars(req)
+	id := vars["id"]
+	idAsInt, err := strconv.Atoi(id)
+	if err != nil {
+		return err, http.StatusBadRequest
+	}
+	event, err := r.backend(req).GetById(idAsInt)
+	if err != nil {
+		return err, http.StatusInternalServerError
+	}
+	if event == nil {
+		return ErrNotFound, http.StatusNotFound
+	}
+	if err := PrincipalFrom(req).CheckWrite(event); err != nil {
+		return err, http.StatusForbidden
+	}
+	if IsTombstone(event) {
+		return ErrDeleted, http.StatusGone
+	}
+
+	tombstone := NewTombstone(event)
+	r.stampEvent(req, tombstone)
+	r.traceEvent(req, tombstone)
+
+	if isSync(req) {
+		return r.syncSave(w, req, tombstone)
 	}
 
-	logger.Infof("Saved event for key %s", e.Key)
-	//fix block on error
-	go func() { r.events <- &e }()
+	// The consumer owns the tombstone once it is published
+	body, err := json.Marshal(tombstone)
+	if err != nil {
+		return err, http.StatusInternalServerError
+	}
+	if err := r.publish(tombstone); err != nil {
+		return unavailable(w, err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	logFor(req).Infof("Deleted event %d for key %s", event.ID, event.Key)
+	w.Write(append(body, '\n'))
 	return nil, 0
 }
 
@@ -189,16 +455,47 @@ func (r *RESTService) searchHandler(w http.ResponseWriter, req *http.Request) (e
 	if err != nil {
 		return err, http.StatusBadRequest
 	}
-	events, err := r.databackend.Query(*q)
+	p := PrincipalFrom(req)
+	queries, err := p.ScopeQuery(q)
 	if err != nil {
-		return err, http.StatusInternalServerError
+		return err, http.StatusForbidden
+	}
+	err, status := r.writePage(w, req, queries, p.Filter)
+	if err != nil {
+		return err, status
 	}
-	enc := json.NewEncoder(w)
-	enc.Encode(events)
 	r.WsServer.Filters <- FilterPair{req.Header.Get("X-User-Id"), *q, 1}
 	return nil, http.StatusOK
 }
 
+// Runs queries and returns each event found once. A limit above zero
+// is passed on to backends implementing LimitQuerier, more reports
+// whether a query may have had more results.
+func (r *RESTService) queryAll(req *http.Request, queries []straumur.Query, limit int) (events []*straumur.Event, more bool, err error) {
+
+	seen := make(map[int]bool)
+	events = []*straumur.Event{}
+	for _, q := range queries {
+		var found []*straumur.Event
+		if _, ok := r.databackend.(LimitQuerier); ok && limit > 0 {
+			found, err = r.backend(req).(LimitQuerier).QueryLimit(q, limit)
+			more = more || len(found) >= limit
+		} else {
+			found, err = r.backend(req).Query(q)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		for _, e := range found {
+			if !seen[e.ID] {
+				seen[e.ID] = true
+				events = append(events, e)
+			}
+		}
+	}
+	return events, more, nil
+}
+
 func (r *RESTService) aggregateHandler(w http.ResponseWriter, req *http.Request) (error, int) {
 	vars := mux.Vars(req)
 	agtype := vars["type"]
@@ -210,17 +507,46 @@ func (r *RESTService) aggregateHandler(w http.ResponseWriter, req *http.Request)
 		return err, http.StatusInternalServerError
 	}
 
-	m, err := r.databackend.AggregateType(*q, agtype)
+	// Aggregates can't be filtered or merged, restricted principals
+	// have to name the entities they aggregate over unless they are
+	// restricted to a single one
+	p := PrincipalFrom(req)
+	queries, err := p.ScopeQuery(q)
+	if err != nil {
+		return err, http.StatusForbidden
+	}
+	if p.restricted() && (len(queries) != 1 || len(queries[0].Entities) == 0) {
+		return ErrEntityRequired, http.StatusForbidden
+	}
+
+	m, err := r.backend(req).AggregateType(queries[0], agtype)
 	if err != nil {
 		return err, http.StatusInternalServerError
 	}
 
+	// Deleted events are stored as tombstones, take them out
+	if queriesTombstones(queries[0].Key) {
+		tq := queries[0]
+		tq.Key = TombstoneKey
+		deleted, err := r.backend(req).AggregateType(tq, agtype)
+		if err != nil {
+			return err, http.StatusInternalServerError
+		}
+		for k, n := range deleted {
+			if m[k] -= n; m[k] <= 0 {
+				delete(m, k)
+			}
+		}
+	}
+
 	enc := json.NewEncoder(w)
 	enc.Encode(m)
 	return nil, http.StatusOK
 }
 
 func (r *RESTService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req = withRequestId(req)
+	w.Header().Set(requestIdHeader, RequestIdFrom(req))
 	router := r.getRouter()
 	router.ServeHTTP(w, req)
 }
@@ -228,13 +554,25 @@ func (r *RESTService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 func (r *RESTService) getRouter() *mux.Router {
 	router := mux.NewRouter()
 	s := router.PathPrefix("/api").Subrouter()
-	s.HandleFunc("/{entity}/{id}/", r.Middleware(r.entityHandler)).Methods("GET")
-	s.HandleFunc("/", r.Middleware(r.saveHandler)).Methods("POST")
-	s.HandleFunc("/{id}/", r.Middleware(r.retrieveHandler)).Methods("GET")
-	s.HandleFunc("/{id}/", r.Middleware(r.saveHandler)).Methods("PUT")
-	s.HandleFunc("/search", r.Middleware(r.searchHandler)).Methods("GET")
-	s.HandleFunc("/aggregate/{type}", r.Middleware(r.aggregateHandler)).Methods("GET")
-	s.HandleFunc("/ws", r.AddSessionIdHeader(r.WsServer.GetHandler().ServeHTTP))
+	s.HandleFunc("/{entity}/{id}/", r.Middleware(r.Scoped(ScopeEventsRead, r.entityHandler))).Methods("GET")
+	s.HandleFunc("/", r.Middleware(r.Scoped(ScopeEventsWrite, r.idempotent(r.saveHandler)))).Methods("POST")
+	s.HandleFunc("/bulk", r.Middleware(r.Scoped(ScopeEventsWrite, r.idempotent(r.bulkHandler)))).Methods("POST")
+	s.HandleFunc("/{id}/", r.Middleware(r.Scoped(ScopeEventsRead, r.retrieveHandler))).Methods("GET")
+	s.HandleFunc("/{id}/", r.Middleware(r.Scoped(ScopeEventsWrite, r.saveHandler))).Methods("PUT")
+	s.HandleFunc("/{id}/", r.Middleware(r.Scoped(ScopeEventsWrite, r.patchHandler))).Methods("PATCH")
+	s.HandleFunc("/{id}/", r.Middleware(r.Scoped(ScopeEventsWrite, r.deleteHandler))).Methods("DELETE")
+	s.HandleFunc("/search", r.Middleware(r.Scoped(ScopeEventsRead, r.searchHandler))).Methods("GET")
+	s.HandleFunc("/aggregate/{type}", r.Middleware(r.Scoped(ScopeAggregateRead, r.aggregateHandler))).Methods("GET")
+	s.HandleFunc("/stream", r.Middleware(r.Scoped(ScopeEventsRead, r.streamHandler))).Methods("GET")
+	s.HandleFunc("/clients", r.Middleware(r.Scoped(ScopeAdmin, r.clientsHandler))).Methods("GET")
+	s.HandleFunc("/schemas", r.Middleware(r.Scoped(ScopeAdmin, r.schemasHandler))).Methods("GET")
+	s.HandleFunc("/schemas/{pattern}", r.Middleware(r.Scoped(ScopeAdmin, r.putSchemaHandler))).Methods("PUT")
+	s.HandleFunc("/schemas/{pattern}", r.Middleware(r.Scoped(ScopeAdmin, r.deleteSchemaHandler))).Methods("DELETE")
+	s.HandleFunc("/ws/token", r.Middleware(r.Scoped(ScopeEventsRead, r.tokenHandler))).Methods("POST")
+	s.HandleFunc("/ws", r.AddSessionIdHeader(r.wsHandler(r.WsServer.GetHandler().ServeHTTP)))
+	router.HandleFunc("/metrics", r.ScopedHandler(ScopeAdmin, r.metricsHandler)).Methods("GET")
+	router.HandleFunc("/healthz", r.healthHandler).Methods("GET")
+	router.HandleFunc("/readyz", r.readyHandler).Methods("GET")
 	return router
 }
 
@@ -247,12 +585,28 @@ func NewRESTService(d straumur.DataBackend, errorChan chan error) *RESTService {
 	defaultHeaders["Access-Control-Allow-Headers"] = "Origin, X-Requested-With, Content-Type, Accept"
 
 	rs := RESTService{
-		Headers:     defaultHeaders,
-		WsServer:    NewWebSocketServer(),
-		events:      make(chan *straumur.Event),
-		databackend: d,
-		errchan:     errorChan,
+		Headers:      defaultHeaders,
+		WsServer:     NewWebSocketServer(),
+		PageSize:     DefaultPageSize,
+		MaxPageSize:  MaxPageSize,
+		SyncTimeout:  DefaultSyncTimeout,
+		ProbeTimeout: DefaultProbeTimeout,
+		StallTimeout: DefaultStallTimeout,
+		QueueSize:    DefaultQueueSize,
+		ReplayTTL:    DefaultIdempotencyTTL,
+		Schemas:      NewSchemaRegistry(),
+		AccessLog:    os.Stderr,
+		events:       make(chan *straumur.Event),
+		databackend:  d,
+		errchan:      errorChan,
+		acks:         newAckRegistry(),
+		idempotency:  newIdempotencyStore(),
+		metrics:      newMetrics(),
 	}
+	rs.StampRequestId = true
+	rs.LateAckTimeout = DefaultLateAckTimeout
+	rs.queue = newIngestQueue(rs.metrics)
+	go rs.queue.run(rs.events)
 	go rs.WsServer.Run(errorChan)
 	return &rs
 }
@@ -262,8 +616,9 @@ func (r *RESTService) Updates() <-chan *straumur.Event {
 	return r.events
 }
 
+// Shuts down with DefaultShutdownTimeout, see Shutdown
 func (r *RESTService) Close() error {
-	close(r.events)
-	//Investigate way to perform graceful shutdown of http
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	return r.Shutdown(ctx)
 }
@@ -84,7 +84,7 @@ func startServer() {
 		for {
 			select {
 			case event := <-rest.Updates():
-				d.Save(event)
+				rest.Ack(event, d.Save(event))
 			}
 		}
 	}()
@@ -198,6 +198,37 @@ func TestPostNewEvent(t *testing.T) {
 	log.Print("Post succeded")
 }
 
+func TestPostNewEventSync(t *testing.T) {
+	once.Do(startServer)
+
+	e := straumur.Event{
+		Key:         "myapp.user.create",
+		Description: "User foobar created",
+		Importance:  3,
+		Origin:      "myapp",
+		Entities:    []string{"user/foo"},
+	}
+
+	url := fmt.Sprintf("http://%s/?sync=true", serverAddr)
+	r := postJSON(t, url, &e)
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusCreated {
+		t.Fatalf("Status code expected %d, got %d", http.StatusCreated, r.StatusCode)
+	}
+
+	var saved straumur.Event
+	if err := json.NewDecoder(r.Body).Decode(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.ID == 0 || saved.Key != e.Key {
+		t.Errorf("Unexpected event %+v", saved)
+	}
+	location := fmt.Sprintf("/api/%d/", saved.ID)
+	if r.Header.Get("Location") != location {
+		t.Errorf("Location expected %s, got %s", location, r.Header.Get("Location"))
+	}
+}
+
 func TestPutEvent(t *testing.T) {
 	log.Println("TestPutEvent")
 	once.Do(startServer)
@@ -0,0 +1,177 @@
+package restservice
+
+import (
+	"encoding/json"
+	"github.com/straumur/straumur"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultProbeTimeout = 2 * time.Second
+	DefaultStallTimeout = 10 * time.Second
+	probeKey            = "straumur.readiness"
+)
+
+// Health states, any state but StatusOK takes the node out of rotation
+const (
+	StatusOK           = "ok"
+	StatusDegraded     = "degraded"
+	StatusDown         = "down"
+	StatusShuttingDown = "shutting_down"
+)
+
+// DataBackends implementing Pinger are probed with Ping instead of a
+// query
+type Pinger interface {
+	Ping() error
+}
+
+// Result of a single health check
+type CheckResult struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Backlog   int64   `json:"backlog,omitempty"`
+	Clients   int     `json:"clients,omitempty"`
+}
+
+// Body of /healthz and /readyz
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+var statusSeverity = map[string]int{
+	StatusOK:           0,
+	StatusDegraded:     1,
+	StatusShuttingDown: 2,
+	StatusDown:         3,
+}
+
+// Sets Status to the worst status of the checks
+func (h *HealthReport) summarize() {
+	h.Status = StatusOK
+	for _, c := range h.Checks {
+		if statusSeverity[c.Status] > statusSeverity[h.Status] {
+			h.Status = c.Status
+		}
+	}
+}
+
+// Reports whether Run answers within timeout and the number of
+// connected clients
+func (s *WebSocketServer) responsive(timeout time.Duration) (int, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// Buffered so Run never blocks on an abandoned check
+	ch := make(chan []ClientStats, 1)
+	select {
+	case s.statsCh <- ch:
+	case <-s.stopped:
+		return 0, false
+	case <-timer.C:
+		return 0, false
+	}
+	select {
+	case stats := <-ch:
+		return len(stats), true
+	case <-timer.C:
+		return 0, false
+	}
+}
+
+func (r *RESTService) checkBroadcaster() CheckResult {
+	t := time.Now()
+	clients, ok := r.WsServer.responsive(r.ProbeTimeout)
+	if !ok {
+		return CheckResult{Status: StatusDown, Error: "broadcaster is not responding"}
+	}
+	return CheckResult{Status: StatusOK, LatencyMs: millis(time.Since(t)), Clients: clients}
+}
+
+// Runs a cheap query against the DataBackend. A probe that is still
+// running when the timeout passes is left to finish on its own.
+func (r *RESTService) checkBackend() CheckResult {
+
+	t := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		if p, ok := r.databackend.(Pinger); ok {
+			done <- p.Ping()
+			return
+		}
+		_, err := r.databackend.Query(straumur.Query{Key: probeKey, From: t, To: t})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return CheckResult{Status: StatusDown, Error: err.Error(), LatencyMs: millis(time.Since(t))}
+		}
+	case <-time.After(r.ProbeTimeout):
+		return CheckResult{Status: StatusDown, Error: "probe timed out", LatencyMs: millis(r.ProbeTimeout)}
+	}
+
+	elapsed := time.Since(t)
+	if elapsed > r.ProbeTimeout/2 {
+		return CheckResult{Status: StatusDegraded, Error: "backend is slow", LatencyMs: millis(elapsed)}
+	}
+	return CheckResult{Status: StatusOK, LatencyMs: millis(elapsed)}
+}
+
+// Checks the consumer of Updates() keeps up, the feed stalls when
+// events are pending and none has been read for StallTimeout
+func (r *RESTService) checkFeed() CheckResult {
+
+	if r.queue.isClosed() {
+		return CheckResult{Status: StatusShuttingDown}
+	}
+
+	backlog := atomic.LoadInt64(&r.metrics.backlog)
+	if backlog == 0 {
+		return CheckResult{Status: StatusOK}
+	}
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&r.metrics.progress)))
+	if idle > r.StallTimeout {
+		return CheckResult{Status: StatusDegraded, Error: "event feed is not draining", Backlog: backlog}
+	}
+	return CheckResult{Status: StatusOK, Backlog: backlog}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func writeHealth(w http.ResponseWriter, report *HealthReport) {
+	report.summarize()
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// GET: /healthz
+// Liveness, the process is up and the broadcaster loop responds
+func (r *RESTService) healthHandler(w http.ResponseWriter, req *http.Request) {
+	writeHealth(w, &HealthReport{Checks: map[string]CheckResult{
+		"broadcaster": r.checkBroadcaster(),
+	}})
+}
+
+// GET: /readyz
+// Readiness, the backend answers queries and the event feed drains
+func (r *RESTService) readyHandler(w http.ResponseWriter, req *http.Request) {
+	writeHealth(w, &HealthReport{Checks: map[string]CheckResult{
+		"broadcaster": r.checkBroadcaster(),
+		"backend":     r.checkBackend(),
+		"event_feed":  r.checkFeed(),
+	}})
+}
@@ -0,0 +1,92 @@
+package restservice
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Backend whose probe fails or hangs
+type pingBackend struct {
+	straumur.DataBackend
+	err   error
+	delay time.Duration
+}
+
+func (p *pingBackend) Ping() error {
+	time.Sleep(p.delay)
+	return p.err
+}
+
+func getHealth(t *testing.T, url string) (int, HealthReport) {
+	r, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	var report HealthReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return r.StatusCode, report
+}
+
+func TestHealthEndpoints(t *testing.T) {
+
+	backend := &pingBackend{DataBackend: straumur.NewLocalMemoryStore()}
+	rest := NewRESTService(backend, make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.ProbeTimeout = 100 * time.Millisecond
+	rest.StallTimeout = 50 * time.Millisecond
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	status, report := getHealth(t, server.URL+"/healthz")
+	if status != http.StatusOK || report.Status != StatusOK {
+		t.Errorf("Expected healthy, got %d %+v", status, report)
+	}
+	status, report = getHealth(t, server.URL+"/readyz")
+	if status != http.StatusOK || report.Checks["backend"].Status != StatusOK {
+		t.Errorf("Expected ready, got %d %+v", status, report)
+	}
+
+	backend.err = errors.New("connection refused")
+	status, report = getHealth(t, server.URL+"/readyz")
+	if status != http.StatusServiceUnavailable || report.Status != StatusDown || report.Checks["backend"].Error != "connection refused" {
+		t.Errorf("Expected the backend to be down, got %d %+v", status, report)
+	}
+
+	backend.err = nil
+	backend.delay = 70 * time.Millisecond
+	_, report = getHealth(t, server.URL+"/readyz")
+	if report.Status != StatusDegraded {
+		t.Errorf("Expected a slow backend to be degraded, got %+v", report)
+	}
+	backend.delay = 0
+
+	// Nobody reads Updates()
+	rest.publish(&straumur.Event{Key: "stuck"})
+	time.Sleep(2 * rest.StallTimeout)
+	status, report = getHealth(t, server.URL+"/readyz")
+	feed := report.Checks["event_feed"]
+	if status != http.StatusServiceUnavailable || feed.Status != StatusDegraded || feed.Backlog != 1 {
+		t.Errorf("Expected a stalled feed, got %d %+v", status, report)
+	}
+
+	<-rest.Updates()
+	status, report = getHealth(t, server.URL+"/readyz")
+	if status != http.StatusOK {
+		t.Errorf("Expected ready once drained, got %d %+v", status, report)
+	}
+
+	rest.WsServer.Done()
+	status, report = getHealth(t, server.URL+"/healthz")
+	if status != http.StatusServiceUnavailable || report.Checks["broadcaster"].Status != StatusDown {
+		t.Errorf("Expected a stopped broadcaster to be down, got %d %+v", status, report)
+	}
+}
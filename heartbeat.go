@@ -0,0 +1,163 @@
+package restservice
+
+import (
+	"bufio"
+	"code.google.com/p/go.net/websocket"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultPingInterval = 30 * time.Second
+	DefaultWriteTimeout = 10 * time.Second
+	DefaultIdleTimeout  = 90 * time.Second
+)
+
+var ErrNotHijackable = errors.New("Connection cannot be hijacked")
+
+// Time of the last bytes read from a connection, including control
+// frames such as pongs which the websocket package handles internally
+type activity struct {
+	last int64
+}
+
+func newActivity() *activity {
+	a := &activity{}
+	a.touch()
+	return a
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *activity) lastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&a.last))
+}
+
+type activityReader struct {
+	r io.Reader
+	a *activity
+}
+
+func (ar *activityReader) Read(p []byte) (int, error) {
+	n, err := ar.r.Read(p)
+	if n > 0 {
+		ar.a.touch()
+	}
+	return n, err
+}
+
+// Records reads on the connection the websocket handshake hijacks
+type activityWriter struct {
+	http.ResponseWriter
+	a *activity
+}
+
+func (aw *activityWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := aw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, ErrNotHijackable
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return conn, brw, err
+	}
+	r := bufio.NewReader(&activityReader{brw.Reader, aw.a})
+	return conn, bufio.NewReadWriter(r, brw.Writer), nil
+}
+
+// Wraps a websocket handler so clients can see the activity of their
+// connection
+func trackActivity(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		a := newActivity()
+		ctx := context.WithValue(req.Context(), activityKey, a)
+		h.ServeHTTP(&activityWriter{w, a}, req.WithContext(ctx))
+	})
+}
+
+// Returns the activity tracked for ws, or a new one when the
+// connection wasn't set up by trackActivity
+func activityOf(ws *websocket.Conn) *activity {
+	if req := ws.Request(); req != nil {
+		if a, ok := req.Context().Value(activityKey).(*activity); ok {
+			return a
+		}
+	}
+	return newActivity()
+}
+
+// Sends an empty ping frame, the peer answers with a pong
+var pingCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		return []byte{}, websocket.PingFrame, nil
+	},
+}
+
+// Pings the client, or closes the connection if nothing has been read
+// from it for longer than the idle timeout
+func (c *Client) heartbeat() {
+
+	idle := time.Since(c.activity.lastSeen())
+	if c.idleTimeout > 0 && idle > c.idleTimeout {
+		c.close("idle for " + idle.String())
+		return
+	}
+
+	if c.idleTimeout > 0 {
+		c.ws.SetReadDeadline(c.activity.lastSeen().Add(c.idleTimeout))
+	}
+	if c.writeTimeout > 0 {
+		c.ws.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	if err := pingCodec.Send(c.ws, nil); err != nil {
+		c.close("ping failed: " + err.Error())
+	}
+}
+
+// Closes the connection, the reader notices and stops the client
+// through the doneCh handshake. Only the first call has an effect.
+func (c *Client) close(reason string) error {
+	if !c.markClosed(reason) {
+		return nil
+	}
+	return c.closeConn()
+}
+
+// Records why the client is closing, returns false if it already was
+func (c *Client) markClosed(reason string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeReason != "" {
+		return false
+	}
+	c.closeReason = reason
+	if c.closed != nil {
+		close(c.closed)
+	}
+	logger.Infof("Closing client %s: %s", c.Id, reason)
+	return true
+}
+
+func (c *Client) closeConn() error {
+	if c.ws == nil {
+		// Stream clients end when their handler sees closed
+		return nil
+	}
+	return c.ws.Close()
+}
+
+// Reports whether a read error means the connection is gone
+func isDisconnect(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
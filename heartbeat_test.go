@@ -0,0 +1,104 @@
+package restservice
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketIdleTimeout(t *testing.T) {
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.WsServer.PingInterval = 50 * time.Millisecond
+	rest.WsServer.IdleTimeout = 200 * time.Millisecond
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws"
+	idle, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("WebSocket handshake error: %v", err)
+	}
+	defer idle.Close()
+
+	live, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("WebSocket handshake error: %v", err)
+	}
+	defer live.Close()
+
+	// Reading answers pings, the idle connection never reads
+	incoming := make(chan straumur.Event)
+	go readEvents(live, incoming)
+
+	time.Sleep(500 * time.Millisecond)
+
+	rest.WsServer.Broadcast(straumur.NewEvent(
+		"heartbeat.test",
+		nil,
+		nil,
+		"Sent after the idle client was reaped",
+		3,
+		"myapp",
+		[]string{"ns/heartbeat"},
+		nil,
+		nil,
+		nil))
+
+	select {
+	case e := <-incoming:
+		if e.Key != "heartbeat.test" {
+			t.Errorf("Unexpected %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Live client was disconnected")
+	}
+
+	var event straumur.Event
+	for {
+		err := websocket.JSON.Receive(idle, &event)
+		if err != nil {
+			break
+		}
+		if event.Key == "heartbeat.test" {
+			t.Fatalf("Idle client was not disconnected")
+		}
+	}
+}
+
+func TestWebSocketIdleWithoutPings(t *testing.T) {
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.WsServer.PingInterval = 0
+	rest.WsServer.IdleTimeout = 300 * time.Millisecond
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws", "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("WebSocket handshake error: %v", err)
+	}
+	defer conn.Close()
+
+	// Commands keep the client from going idle
+	for i := 0; i < 7; i++ {
+		if err := websocket.JSON.Send(conn, Command{Command: CommandList}); err != nil {
+			t.Fatalf("Client was disconnected after %d commands: %v", i, err)
+		}
+		receiveMessage(t, conn, MessageSubscriptions)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Silence is idle
+	time.Sleep(500 * time.Millisecond)
+	var msg Message
+	if err := websocket.JSON.Receive(conn, &msg); err == nil {
+		t.Errorf("Expected the idle client to be disconnected, got %+v", msg)
+	}
+}
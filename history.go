@@ -0,0 +1,90 @@
+package restservice
+
+import (
+	"github.com/straumur/straumur"
+)
+
+const DefaultHistorySize = 1000
+
+// Bounded ring of recently broadcast events, oldest first
+type eventRing struct {
+	events []*straumur.Event
+	start  int
+	size   int
+}
+
+func newEventRing(capacity int) *eventRing {
+	return &eventRing{events: make([]*straumur.Event, capacity)}
+}
+
+func (r *eventRing) add(e *straumur.Event) {
+	if len(r.events) == 0 {
+		return
+	}
+	if r.size < len(r.events) {
+		r.events[(r.start+r.size)%len(r.events)] = e
+		r.size++
+		return
+	}
+	r.events[r.start] = e
+	r.start = (r.start + 1) % len(r.events)
+}
+
+func (r *eventRing) at(i int) *straumur.Event {
+	return r.events[(r.start+i)%len(r.events)]
+}
+
+// Returns the events broadcast after the latest one with the given
+// id. If that event has already left the ring, every event with a
+// higher id is returned and complete is false.
+func (r *eventRing) since(id int) (events []*straumur.Event, complete bool) {
+
+	from := -1
+	for i := r.size - 1; i >= 0; i-- {
+		if r.at(i).ID == id {
+			from = i
+			break
+		}
+	}
+
+	events = []*straumur.Event{}
+	for i := from + 1; i < r.size; i++ {
+		e := r.at(i)
+		if from >= 0 || e.ID > id {
+			events = append(events, e)
+		}
+	}
+	return events, from >= 0
+}
+
+// A subscription waiting for the events it missed
+type replayRequest struct {
+	client *Client
+	cmd    *Command
+}
+
+// Registers the subscription and sends the missed events matching it
+// to the client ahead of live broadcasts. Runs in the Run loop so no
+// broadcast can slip in between.
+func (s *WebSocketServer) replay(req replayRequest) {
+
+	msg := req.client.subscribe(req.cmd)
+	if msg.Type != MessageSubscribed {
+		req.client.send(msg)
+		return
+	}
+
+	events, complete := s.history.since(*req.cmd.Since)
+
+	missed := []*straumur.Event{}
+	for _, e := range events {
+		if req.cmd.Query.Match(matchTarget(e)) && req.client.principal.CanRead(e) {
+			missed = append(missed, e)
+		}
+	}
+
+	msg.Events = missed
+	msg.Truncated = !complete
+	logger.Infof("Replaying %d events to client %s, complete: %t", len(missed), req.client.Id, complete)
+	req.client.send(msg)
+}
@@ -0,0 +1,37 @@
+package restservice
+
+import (
+	"fmt"
+	"github.com/straumur/straumur"
+	"testing"
+)
+
+func TestEventRing(t *testing.T) {
+
+	ring := newEventRing(3)
+	for i := 1; i <= 5; i++ {
+		ring.add(&straumur.Event{ID: i})
+	}
+
+	events, complete := ring.since(3)
+	if !complete || fmt.Sprint(ids(events)) != "[4 5]" {
+		t.Errorf("Unexpected %v, complete: %t", ids(events), complete)
+	}
+
+	events, complete = ring.since(5)
+	if !complete || len(events) != 0 {
+		t.Errorf("Unexpected %v, complete: %t", ids(events), complete)
+	}
+
+	events, complete = ring.since(1)
+	if complete || fmt.Sprint(ids(events)) != "[3 4 5]" {
+		t.Errorf("Unexpected %v, complete: %t", ids(events), complete)
+	}
+
+	// Updates are broadcast again with their original id
+	ring.add(&straumur.Event{ID: 4})
+	events, complete = ring.since(4)
+	if !complete || len(events) != 0 {
+		t.Errorf("Unexpected %v, complete: %t", ids(events), complete)
+	}
+}
@@ -0,0 +1,312 @@
+package restservice
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	IdempotencyKeyHeader   = "Idempotency-Key"
+	DefaultIdempotencyTTL  = 24 * time.Hour
+	DefaultIdempotencyKeys = 100000
+	maxIdempotencyKey      = 255
+)
+
+var (
+	ErrBadIdempotencyKey    = errors.New("Invalid Idempotency-Key")
+	ErrIdempotencyKeyReused = errors.New("Idempotency-Key was used with a different request")
+	ErrRequestInProgress    = errors.New("A request with this Idempotency-Key is in progress")
+)
+
+// Outcome of the first request with an idempotency key, replayed for
+// duplicates until it expires
+type idempotentEntry struct {
+	done        bool
+	fingerprint []byte
+	// Error returned by the handler, written by Middleware
+	err    error
+	status int
+	// Headers the handler set and the body it wrote
+	header  http.Header
+	body    []byte
+	expires time.Time
+	// Position in the finished entries
+	el *list.Element
+}
+
+// Keeps the outcomes of at most max finished requests, dropping the
+// oldest when full. Requests in progress are not counted.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentEntry
+	// Keys of finished entries, oldest first
+	finished *list.List
+	max      int
+	now      func() time.Time
+}
+
+func newIdempotencyStore() *idempotencyStore {
+	return &idempotencyStore{
+		entries:  make(map[string]*idempotentEntry),
+		finished: list.New(),
+		max:      DefaultIdempotencyKeys,
+		now:      time.Now,
+	}
+}
+
+// Returns the entry of key, or reserves key and returns nil when the
+// request is the first one
+func (s *idempotencyStore) begin(key string) *idempotentEntry {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	if e, ok := s.entries[key]; ok && (!e.done || now.Before(e.expires)) {
+		c := *e
+		return &c
+	}
+	s.remove(key)
+	s.entries[key] = &idempotentEntry{}
+	return nil
+}
+
+func (s *idempotencyStore) finish(key string, e *idempotentEntry, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+	for s.finished.Len() >= s.max {
+		s.remove(s.finished.Front().Value.(string))
+	}
+	e.done = true
+	e.expires = s.now().Add(ttl)
+	e.el = s.finished.PushBack(key)
+	s.entries[key] = e
+}
+
+// Releases key so the request can be retried
+func (s *idempotencyStore) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+}
+
+func (s *idempotencyStore) remove(key string) {
+	if e, ok := s.entries[key]; ok {
+		if e.el != nil {
+			s.finished.Remove(e.el)
+		}
+		delete(s.entries, key)
+	}
+}
+
+// Drops expired entries, oldest first
+func (s *idempotencyStore) sweep(now time.Time) {
+	for el := s.finished.Front(); el != nil; el = s.finished.Front() {
+		key := el.Value.(string)
+		if now.Before(s.entries[key].expires) {
+			return
+		}
+		s.remove(key)
+	}
+}
+
+// Completes an idempotent request whose sync save timed out once the
+// save is acknowledged, err releases the key
+type lateResponse func(err error, status int, header http.Header, body []byte)
+
+func lateResponseFrom(req *http.Request) lateResponse {
+	f, _ := req.Context().Value(lateResponseKey).(lateResponse)
+	return f
+}
+
+// Records what a handler writes while passing it through
+type responseCapture struct {
+	http.ResponseWriter
+	before http.Header
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+		c.header = changedHeaders(c.before, c.Header())
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// Returns the headers of after that differ from before, leaving out
+// the ones Middleware sets for every request
+func changedHeaders(before, after http.Header) http.Header {
+	h := make(http.Header)
+	for k, v := range after {
+		if old, ok := before[k]; ok && equalValues(old, v) {
+			continue
+		}
+		h[k] = append([]string(nil), v...)
+	}
+	return h
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// Hashes the request body as the handler reads it
+type hashingBody struct {
+	io.Reader
+	io.Closer
+	hash hash.Hash
+}
+
+func newHashingBody(req *http.Request) *hashingBody {
+	h := sha256.New()
+	h.Write([]byte(req.URL.RawQuery + "\n"))
+	return &hashingBody{io.TeeReader(req.Body, h), req.Body, h}
+}
+
+// Reads what the handler left and returns the fingerprint of the
+// request
+func (b *hashingBody) sum() []byte {
+	io.Copy(ioutil.Discard, b.Reader)
+	return b.hash.Sum(nil)
+}
+
+// Makes f safe to retry. Requests with an Idempotency-Key header are
+// handled once, duplicates within ReplayTTL get the original
+// response. Keys are scoped to the principal, or the remote IP without
+// authentication, and the route. Responses to requests that were not
+// accepted, 5xx, are not kept so the request can be retried. When a
+// sync save times out the key stays in progress until the save is
+// acknowledged and its outcome is kept, or is released after
+// LateAckTimeout.
+func (r *RESTService) idempotent(f func(http.ResponseWriter, *http.Request) (error, int)) func(http.ResponseWriter, *http.Request) (error, int) {
+
+	return func(w http.ResponseWriter, req *http.Request) (error, int) {
+
+		key := req.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			return f(w, req)
+		}
+		if len(key) > maxIdempotencyKey {
+			return ErrBadIdempotencyKey, http.StatusBadRequest
+		}
+
+		scoped := RateKeyDefault(req) + "\x00" + routeOf(req) + "\x00" + key
+
+		body := newHashingBody(req)
+		req.Body = body
+
+		if e := r.idempotency.begin(scoped); e != nil {
+			if !e.done {
+				w.Header().Set("Retry-After", "1")
+				return ErrRequestInProgress, http.StatusConflict
+			}
+			if !bytes.Equal(e.fingerprint, body.sum()) {
+				return ErrIdempotencyKeyReused, http.StatusUnprocessableEntity
+			}
+			logFor(req).Infof("Replaying response for Idempotency-Key %s", key)
+			return replay(w, e)
+		}
+
+		finished := false
+		defer func() {
+			if !finished {
+				r.idempotency.forget(scoped)
+			}
+		}()
+
+		fingerprint := make(chan []byte, 1)
+		var late lateResponse = func(err error, status int, header http.Header, body []byte) {
+			if err != nil {
+				r.idempotency.forget(scoped)
+				return
+			}
+			r.idempotency.finish(scoped, &idempotentEntry{
+				fingerprint: <-fingerprint,
+				status:      status,
+				header:      header,
+				body:        body,
+			}, r.ReplayTTL)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), lateResponseKey, late))
+
+		c := &responseCapture{ResponseWriter: w, before: cloneHeader(w.Header())}
+		err, status := f(c, req)
+		fingerprint <- body.sum()
+
+		if err == ErrSaveTimeout {
+			finished = true
+			return err, status
+		}
+		if err != nil && status >= 500 {
+			return err, status
+		}
+		if err == nil {
+			status = c.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+		}
+		r.idempotency.finish(scoped, &idempotentEntry{
+			fingerprint: <-fingerprint,
+			err:         err,
+			status:      status,
+			header:      c.header,
+			body:        c.body.Bytes(),
+		}, r.ReplayTTL)
+		finished = true
+		return err, status
+	}
+}
+
+// Writes the stored response, errors are written by Middleware
+func replay(w http.ResponseWriter, e *idempotentEntry) (error, int) {
+	w.Header().Set("Idempotent-Replayed", "true")
+	if e.err != nil {
+		return e.err, e.status
+	}
+	for k, v := range e.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+	return nil, e.status
+}
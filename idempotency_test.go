@@ -0,0 +1,189 @@
+package restservice
+
+import (
+	"encoding/json"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	post := func(path, key, body string) (*http.Response, string) {
+		req, _ := http.NewRequest("POST", server.URL+path, strings.NewReader(body))
+		req.Header.Set(IdempotencyKeyHeader, key)
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		b, _ := ioutil.ReadAll(r.Body)
+		return r, string(b)
+	}
+
+	event := `{"key": "idempotent", "origin": "myapp"}`
+	if r, _ := post("/api/", "retry-1", event); r.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d", http.StatusCreated, r.StatusCode)
+	}
+	r, _ := post("/api/", "retry-1", event)
+	if r.StatusCode != http.StatusCreated || r.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected a replayed %d, got %d %v", http.StatusCreated, r.StatusCode, r.Header)
+	}
+
+	<-rest.Updates()
+	select {
+	case e := <-rest.Updates():
+		t.Errorf("Expected a single event, got a duplicate %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r, body := post("/api/", "retry-1", `{"key": "other", "origin": "myapp"}`)
+	var apiErr ErrorResponse
+	json.Unmarshal([]byte(body), &apiErr)
+	if r.StatusCode != http.StatusUnprocessableEntity || apiErr.Code != CodeIdempotencyKeyReused {
+		t.Errorf("Expected a reused key to be rejected, got %d %s", r.StatusCode, body)
+	}
+
+	// Keys are scoped to the route
+	go func() { <-rest.Updates() }()
+	bulk := `[{"key": "bulk.idempotent", "origin": "myapp"}, {"origin": "myapp"}]`
+	first, firstBody := post("/api/bulk", "retry-1", bulk)
+	second, secondBody := post("/api/bulk", "retry-1", bulk)
+	if first.StatusCode != second.StatusCode || firstBody != secondBody || second.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the bulk response to be replayed, got %d %s and %d %s", first.StatusCode, firstBody, second.StatusCode, secondBody)
+	}
+
+	if r, _ := post("/api/", strings.Repeat("k", maxIdempotencyKey+1), event); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an oversized key to be rejected, got %d", r.StatusCode)
+	}
+}
+
+func TestIdempotencyStore(t *testing.T) {
+
+	now := time.Unix(1000, 0)
+	s := newIdempotencyStore()
+	s.now = func() time.Time { return now }
+
+	if e := s.begin("a"); e != nil {
+		t.Fatalf("Expected the first request to reserve the key, got %+v", e)
+	}
+	if e := s.begin("a"); e == nil || e.done {
+		t.Errorf("Expected the key to be in progress, got %+v", e)
+	}
+
+	s.finish("a", &idempotentEntry{status: http.StatusCreated}, time.Minute)
+	if e := s.begin("a"); e == nil || !e.done || e.status != http.StatusCreated {
+		t.Errorf("Expected the stored response, got %+v", e)
+	}
+
+	s.forget("b")
+	s.begin("b")
+	s.forget("b")
+	if e := s.begin("b"); e != nil {
+		t.Errorf("Expected a forgotten key to be free, got %+v", e)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if e := s.begin("a"); e != nil {
+		t.Errorf("Expected the key to have expired, got %+v", e)
+	}
+
+	s.max = 2
+	for _, key := range []string{"x", "y", "z"} {
+		s.begin(key)
+		s.finish(key, &idempotentEntry{status: http.StatusCreated}, time.Minute)
+	}
+	if e := s.begin("x"); e != nil {
+		t.Errorf("Expected the oldest key to be evicted, got %+v", e)
+	}
+	if e := s.begin("z"); e == nil || !e.done {
+		t.Errorf("Expected the newest key to be kept, got %+v", e)
+	}
+}
+
+func TestIdempotencySyncTimeout(t *testing.T) {
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.SyncTimeout = 50 * time.Millisecond
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	post := func() *http.Response {
+		req, _ := http.NewRequest("POST", server.URL+"/api/?sync=true", strings.NewReader(`{"key": "slow", "origin": "myapp"}`))
+		req.Header.Set(IdempotencyKeyHeader, "slow-1")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r
+	}
+
+	if r := post(); r.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("Expected %d, got %d", http.StatusGatewayTimeout, r.StatusCode)
+	}
+	// The save may still succeed, so a retry must not save again
+	if r := post(); r.StatusCode != http.StatusConflict {
+		t.Errorf("Expected the request to be in progress, got %d", r.StatusCode)
+	}
+
+	e := <-rest.Updates()
+	e.ID = 1
+	rest.Ack(e, nil)
+	time.Sleep(20 * time.Millisecond)
+
+	r := post()
+	if r.StatusCode != http.StatusCreated || r.Header.Get("Location") != "/api/1/" || r.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the outcome of the save, got %d %v", r.StatusCode, r.Header)
+	}
+
+	// A lost Ack releases the key after LateAckTimeout
+	rest.LateAckTimeout = 50 * time.Millisecond
+	req, _ := http.NewRequest("POST", server.URL+"/api/?sync=true", strings.NewReader(`{"key": "lost", "origin": "myapp"}`))
+	req.Header.Set(IdempotencyKeyHeader, "lost-1")
+	if r, err := http.DefaultClient.Do(req); err != nil || r.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("Expected %d, got %v %v", http.StatusGatewayTimeout, r, err)
+	}
+	<-rest.Updates()
+	time.Sleep(100 * time.Millisecond)
+	req, _ = http.NewRequest("POST", server.URL+"/api/?sync=true", strings.NewReader(`{"key": "lost", "origin": "myapp"}`))
+	req.Header.Set(IdempotencyKeyHeader, "lost-1")
+	go func() {
+		e := <-rest.Updates()
+		rest.Ack(e, nil)
+	}()
+	if r, err := http.DefaultClient.Do(req); err != nil || r.StatusCode != http.StatusCreated || r.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("Expected the retry to be saved, got %v %v", r, err)
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	calls := 0
+	f := rest.idempotent(func(w http.ResponseWriter, req *http.Request) (error, int) {
+		calls++
+		return nil, http.StatusCreated
+	})
+
+	for _, addr := range []string{"10.0.0.1:1000", "10.0.0.2:1000", "10.0.0.1:2000"} {
+		req := httptest.NewRequest("POST", "/api/", strings.NewReader("{}"))
+		req.Header.Set(IdempotencyKeyHeader, "shared")
+		req.RemoteAddr = addr
+		f(httptest.NewRecorder(), req)
+	}
+	if calls != 2 {
+		t.Errorf("Expected keys to be scoped to the remote IP, got %d calls", calls)
+	}
+}
@@ -0,0 +1,120 @@
+package restservice
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/straumur/straumur"
+	"net/http"
+	"time"
+)
+
+// KeyParams entry holding the id of the request an event was
+// submitted with
+const RequestIdParam = "request_id"
+
+// Reports whether a client supplied request id is safe to log and
+// echo, others are replaced
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Returns a copy of req carrying its request id
+func withRequestId(req *http.Request) *http.Request {
+	ctx := context.WithValue(req.Context(), requestIdKey, requestId(req))
+	return req.WithContext(ctx)
+}
+
+// Returns the id of the request, accepted from X-Request-Id or
+// generated
+func RequestIdFrom(req *http.Request) string {
+	if id, ok := req.Context().Value(requestIdKey).(string); ok {
+		return id
+	}
+	return requestId(req)
+}
+
+// Records the request id in the KeyParams of e when StampRequestId
+// is set
+func (r *RESTService) stampEvent(req *http.Request, e *straumur.Event) {
+	if !r.StampRequestId {
+		return
+	}
+	if e.KeyParams == nil {
+		e.KeyParams = make(map[string]interface{})
+	}
+	e.KeyParams[RequestIdParam] = RequestIdFrom(req)
+}
+
+// Logs through the package logger with the request id as prefix
+type requestLogger struct {
+	prefix string
+}
+
+func logFor(req *http.Request) requestLogger {
+	return requestLogger{"[" + RequestIdFrom(req) + "] "}
+}
+
+func (l requestLogger) Debugf(format string, args ...interface{}) {
+	logger.Debugf(l.prefix+format, args...)
+}
+
+func (l requestLogger) Infof(format string, args ...interface{}) {
+	logger.Infof(l.prefix+format, args...)
+}
+
+func (l requestLogger) Warningf(format string, args ...interface{}) {
+	logger.Warningf(l.prefix+format, args...)
+}
+
+func (l requestLogger) Errorf(format string, args ...interface{}) {
+	logger.Errorf(l.prefix+format, args...)
+}
+
+// Line of the access log
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	RequestId  string    `json:"request_id"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs float64   `json:"duration_ms"`
+	ClientId   string    `json:"client_id,omitempty"`
+}
+
+// Writes the access log line of a request to AccessLog
+func (r *RESTService) logAccess(req *http.Request, rec *statusRecorder, start time.Time, elapsed time.Duration) {
+	if r.AccessLog == nil {
+		return
+	}
+	b, err := json.Marshal(accessEntry{
+		Time:       start.UTC(),
+		RequestId:  RequestIdFrom(req),
+		Method:     req.Method,
+		Route:      routeOf(req),
+		Path:       req.URL.Path,
+		Status:     rec.status,
+		Bytes:      rec.bytes,
+		DurationMs: millis(elapsed),
+		ClientId:   req.Header.Get("X-User-Id"),
+	})
+	if err != nil {
+		logFor(req).Errorf("%v", err)
+		return
+	}
+	r.accessMu.Lock()
+	defer r.accessMu.Unlock()
+	r.AccessLog.Write(append(b, '\n'))
+}
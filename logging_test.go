@@ -0,0 +1,98 @@
+package restservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidRequestId(t *testing.T) {
+	tests := []struct {
+		Id    string
+		Valid bool
+	}{
+		{"", false},
+		{"abc-123", true},
+		{"7f1c2b9e-1b7a-4c1e-9a53-2b1c8d3f4e5a", true},
+		{"trace:span.1_2", true},
+		{"bad id", false},
+		{"%s%s", false},
+		{"line\nbreak", false},
+		{string(make([]byte, 129)), false},
+	}
+	for _, test := range tests {
+		if validRequestId(test.Id) != test.Valid {
+			t.Errorf("%q: expected %v", test.Id, test.Valid)
+		}
+	}
+}
+
+func TestRequestIdPropagation(t *testing.T) {
+
+	var accessLog bytes.Buffer
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.AccessLog = &accessLog
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	post := func(id, body string) *http.Response {
+		req, _ := http.NewRequest("POST", server.URL+"/api/", bytes.NewBufferString(body))
+		req.Header.Set(requestIdHeader, id)
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := post("abc-123", `{"key": "request.id", "origin": "myapp"}`)
+	r.Body.Close()
+	if got := r.Header.Get(requestIdHeader); got != "abc-123" {
+		t.Errorf("Expected the request id to be echoed, got %q", got)
+	}
+	e := <-rest.Updates()
+	if e.KeyParams[RequestIdParam] != "abc-123" {
+		t.Errorf("Expected the event to carry the request id, got %+v", e.KeyParams)
+	}
+
+	req, _ := http.NewRequest("POST", server.URL+"/api/bulk", bytes.NewBufferString(`[{"key": "request.bulk", "origin": "myapp"}]`))
+	req.Header.Set(requestIdHeader, "bulk-1")
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if e := <-rest.Updates(); e.KeyParams[RequestIdParam] != "bulk-1" {
+		t.Errorf("Expected bulk events to carry the request id, got %+v", e.KeyParams)
+	}
+
+	rest.StampRequestId = false
+	post("abc-456", `{"key": "request.id", "origin": "myapp"}`).Body.Close()
+	if e := <-rest.Updates(); len(e.KeyParams) != 0 {
+		t.Errorf("Expected the event to be left as submitted, got %+v", e.KeyParams)
+	}
+
+	r = post("not a valid id", `{"id": 5}`)
+	defer r.Body.Close()
+	id := r.Header.Get(requestIdHeader)
+	if id == "" || id == "not a valid id" {
+		t.Errorf("Expected the invalid request id to be replaced, got %q", id)
+	}
+	var body ErrorResponse
+	json.NewDecoder(r.Body).Decode(&body)
+	if body.RequestId != id {
+		t.Errorf("Expected %s in the error response, got %+v", id, body)
+	}
+	// Every line of the access log is a JSON object
+	lines := strings.Split(strings.TrimSpace(accessLog.String()), "\n")
+	var entry accessEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil || len(lines) != 4 || entry.RequestId != "abc-123" {
+		t.Errorf("Expected an entry per request, got %v %q", err, lines)
+	}
+}
@@ -0,0 +1,263 @@
+package restservice
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds in seconds of the request latency histogram buckets
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestLabels struct {
+	route  string
+	method string
+	status int
+}
+
+// Cumulative latency histogram of one route, method and status
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Collects the metrics of a RESTService, exposed on /metrics in the
+// Prometheus text format
+type metrics struct {
+	// Accessed atomically, kept first for 64-bit alignment
+	accepted uint64
+	backlog  int64
+	// Unix nanoseconds of the last read from Updates(), or of the
+	// backlog becoming non-empty
+	progress int64
+	mu       sync.Mutex
+	requests map[requestLabels]*histogram
+	rejected map[string]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[requestLabels]*histogram),
+		rejected: make(map[string]uint64),
+	}
+}
+
+func (m *metrics) observeRequest(route, method string, status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := requestLabels{route, method, status}
+	h, ok := m.requests[l]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.requests[l] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// Counts the outcome of saving an event
+func (m *metrics) eventSaved(err error, status int) {
+	if err == nil {
+		atomic.AddUint64(&m.accepted, 1)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejected[statusErrorCode(err, status)]++
+}
+
+// Counts the outcome of a bulk request
+func (m *metrics) bulkSaved(results []BulkResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range results {
+		if r.Status == bulkRejected {
+			m.rejected[r.Code]++
+		} else {
+			atomic.AddUint64(&m.accepted, 1)
+		}
+	}
+}
+
+// Tracks events waiting to be read from Updates()
+func (m *metrics) queued(n int) {
+	backlog := atomic.AddInt64(&m.backlog, int64(n))
+	if n < 0 || backlog == int64(n) {
+		atomic.StoreInt64(&m.progress, time.Now().UnixNano())
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Quotes a label value
+func labelValue(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
+
+func writeHelp(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (m *metrics) writeRequests(w io.Writer) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := make([]requestLabels, 0, len(m.requests))
+	for l := range m.requests {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := labels[i], labels[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+
+	writeHelp(w, "straumur_http_requests_total", "counter", "HTTP requests by route, method and status.")
+	for _, l := range labels {
+		fmt.Fprintf(w, "straumur_http_requests_total{route=%s,method=%s,status=\"%d\"} %d\n",
+			labelValue(l.route), labelValue(l.method), l.status, m.requests[l].count)
+	}
+
+	writeHelp(w, "straumur_http_request_duration_seconds", "histogram", "HTTP request latency by route, method and status.")
+	for _, l := range labels {
+		h := m.requests[l]
+		prefix := fmt.Sprintf("route=%s,method=%s,status=\"%d\"", labelValue(l.route), labelValue(l.method), l.status)
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(w, "straumur_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", prefix, formatFloat(b), h.counts[i])
+		}
+		fmt.Fprintf(w, "straumur_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", prefix, h.count)
+		fmt.Fprintf(w, "straumur_http_request_duration_seconds_sum{%s} %s\n", prefix, formatFloat(h.sum))
+		fmt.Fprintf(w, "straumur_http_request_duration_seconds_count{%s} %d\n", prefix, h.count)
+	}
+}
+
+func (m *metrics) writeEvents(w io.Writer) {
+
+	writeHelp(w, "straumur_events_accepted_total", "counter", "Events accepted for saving.")
+	fmt.Fprintf(w, "straumur_events_accepted_total %d\n", atomic.LoadUint64(&m.accepted))
+
+	m.mu.Lock()
+	codes := make([]string, 0, len(m.rejected))
+	for code := range m.rejected {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	writeHelp(w, "straumur_events_rejected_total", "counter", "Events rejected by error code.")
+	for _, code := range codes {
+		fmt.Fprintf(w, "straumur_events_rejected_total{code=%s} %d\n", labelValue(code), m.rejected[code])
+	}
+	m.mu.Unlock()
+
+	writeHelp(w, "straumur_event_feed_backlog", "gauge", "Events waiting to be read from the event feed.")
+	fmt.Fprintf(w, "straumur_event_feed_backlog %d\n", atomic.LoadInt64(&m.backlog))
+}
+
+// Writes the broadcaster metrics, stats are those of the connected
+// clients
+func writeServerMetrics(w io.Writer, s *WebSocketServer, stats []ClientStats) {
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Id < stats[j].Id })
+
+	writeHelp(w, "straumur_websocket_clients", "gauge", "Connected websocket and stream clients.")
+	fmt.Fprintf(w, "straumur_websocket_clients %d\n", len(stats))
+
+	writeHelp(w, "straumur_broadcasts_sent_total", "counter", "Broadcasts sent by client.")
+	for _, c := range stats {
+		fmt.Fprintf(w, "straumur_broadcasts_sent_total{client=%s} %d\n", labelValue(c.Id), c.Sent)
+	}
+	writeHelp(w, "straumur_broadcasts_dropped_total", "counter", "Broadcasts dropped by client.")
+	for _, c := range stats {
+		fmt.Fprintf(w, "straumur_broadcasts_dropped_total{client=%s} %d\n", labelValue(c.Id), c.Dropped)
+	}
+
+	writeHelp(w, "straumur_filter_pair_retries_total", "counter", "Filters requeued because their client wasn't found.")
+	fmt.Fprintf(w, "straumur_filter_pair_retries_total %d\n", atomic.LoadUint64(&s.filterRetries))
+	writeHelp(w, "straumur_filter_pair_drops_total", "counter", "Filters dropped after running out of attempts.")
+	fmt.Fprintf(w, "straumur_filter_pair_drops_total %d\n", atomic.LoadUint64(&s.filterDrops))
+}
+
+// Records the status and size of the response written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Keeps streaming working through the recorder
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T is not a http.Hijacker", s.ResponseWriter)
+	}
+	return h.Hijack()
+}
+
+// Returns the route template of the request, e.g. /api/{id}/
+func routeOf(req *http.Request) string {
+	if route := mux.CurrentRoute(req); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return "unmatched"
+}
+
+// GET: /metrics
+// Prometheus text format
+func (r *RESTService) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.metrics.writeRequests(w)
+	r.metrics.writeEvents(w)
+	writeServerMetrics(w, r.WsServer, r.WsServer.Stats())
+}
@@ -0,0 +1,70 @@
+package restservice
+
+import (
+	"bytes"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	go func() {
+		for range rest.Updates() {
+		}
+	}()
+
+	for _, body := range []string{`{"key": "metrics.test", "origin": "myapp"}`, `{"id": 5}`} {
+		r, err := http.Post(server.URL+"/api/", "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+	}
+	r, err := http.Get(server.URL + "/api/search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	rest.WsServer.Filters <- FilterPair{Id: "nobody", Attempts: 3}
+
+	r, err = http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	b, _ := ioutil.ReadAll(r.Body)
+	text := string(b)
+
+	for _, expected := range []string{
+		`straumur_http_requests_total{route="/api/",method="POST",status="201"} 1`,
+		`straumur_http_requests_total{route="/api/",method="POST",status="400"} 1`,
+		`straumur_http_requests_total{route="/api/search",method="GET",status="200"} 1`,
+		`straumur_http_request_duration_seconds_bucket{route="/api/search",method="GET",status="200",le="+Inf"} 1`,
+		`straumur_events_accepted_total 1`,
+		`straumur_events_rejected_total{code="save_existing"} 1`,
+		`straumur_event_feed_backlog 0`,
+		`straumur_websocket_clients 0`,
+		`straumur_filter_pair_drops_total 1`,
+	} {
+		if !strings.Contains(text, expected+"\n") {
+			t.Errorf("Missing %s in\n%s", expected, text)
+		}
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	if v := labelValue("a\"b\\c\nd"); v != `"a\"b\\c\nd"` {
+		t.Errorf("Unexpected %s", v)
+	}
+}
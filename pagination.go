@@ -0,0 +1,286 @@
+package restservice
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+	limitParam      = "limit"
+	cursorParam     = "cursor"
+)
+
+var (
+	ErrInvalidCursor = errors.New("Invalid cursor")
+	ErrInvalidLimit  = errors.New("Invalid limit")
+)
+
+// Position in a result set, events are ordered newest first by
+// Created and then by ID
+type cursor struct {
+	Created time.Time
+	ID      int
+	// Prev cursors page towards newer events
+	Prev bool
+}
+
+func cursorFor(e *straumur.Event, prev bool) *cursor {
+	return &cursor{e.Created, e.ID, prev}
+}
+
+// Returns the opaque representation of the cursor
+func (c *cursor) String() string {
+	dir := "n"
+	if c.Prev {
+		dir = "p"
+	}
+	s := fmt.Sprintf("%s:%d:%d", dir, c.Created.UnixNano(), c.ID)
+	return base64.URLEncoding.EncodeToString([]byte(s))
+}
+
+// Parses an opaque cursor created by cursor.String
+func parseCursor(s string) (*cursor, error) {
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.Split(string(b), ":")
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "p") {
+		return nil, ErrInvalidCursor
+	}
+	nsec, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor{time.Unix(0, nsec), id, parts[0] == "p"}, nil
+}
+
+// Reports whether e is listed before the cursor position
+func (c *cursor) before(e *straumur.Event) bool {
+	if e.Created.Equal(c.Created) {
+		return e.ID > c.ID
+	}
+	return e.Created.After(c.Created)
+}
+
+// Reports whether e is listed after the cursor position
+func (c *cursor) after(e *straumur.Event) bool {
+	if e.Created.Equal(c.Created) {
+		return e.ID < c.ID
+	}
+	return e.Created.Before(c.Created)
+}
+
+// DataBackends implementing LimitQuerier return at most limit events
+// of a query, newest first, so a page is read without loading the
+// rest of the result set
+type LimitQuerier interface {
+	QueryLimit(q straumur.Query, limit int) ([]*straumur.Event, error)
+}
+
+// Restricts q to the events at and beyond the cursor position, the
+// order within the same instant is left to paginate
+func (c *cursor) narrow(q *straumur.Query) {
+	if c.Prev {
+		if q.From.IsZero() || c.Created.After(q.From) {
+			q.From = c.Created
+		}
+		return
+	}
+	if q.To.IsZero() || c.Created.Before(q.To) {
+		q.To = c.Created
+	}
+}
+
+// Sorts events newest first
+type byCreatedDesc []*straumur.Event
+
+func (s byCreatedDesc) Len() int      { return len(s) }
+func (s byCreatedDesc) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCreatedDesc) Less(i, j int) bool {
+	if s[i].Created.Equal(s[j].Created) {
+		return s[i].ID > s[j].ID
+	}
+	return s[i].Created.After(s[j].Created)
+}
+
+// A slice of a result set along with cursors to its neighbours
+type page struct {
+	Events []*straumur.Event
+	Next   *cursor
+	Prev   *cursor
+}
+
+// Cuts a page of at most limit events from events, starting at c.
+// events is left as is, it may be owned by the backend.
+func paginate(events []*straumur.Event, c *cursor, limit int) page {
+
+	events = append([]*straumur.Event(nil), events...)
+	sort.Sort(byCreatedDesc(events))
+
+	n := len(events)
+	start, end := 0, n
+
+	switch {
+	case c == nil:
+	case c.Prev:
+		end = sort.Search(n, func(i int) bool { return !c.before(events[i]) })
+		start = end - limit
+		if start < 0 {
+			start = 0
+		}
+	default:
+		start = sort.Search(n, func(i int) bool { return c.after(events[i]) })
+	}
+
+	if c == nil || !c.Prev {
+		end = start + limit
+		if end > n {
+			end = n
+		}
+	}
+
+	p := page{Events: events[start:end]}
+	if end < n && end > 0 {
+		p.Next = cursorFor(events[end-1], false)
+	}
+	if start > 0 && start < n {
+		p.Prev = cursorFor(events[start], true)
+	}
+	return p
+}
+
+// Parses the limit and cursor params from the request
+func (r *RESTService) getPaging(req *http.Request) (*cursor, int, error) {
+
+	req.ParseForm()
+
+	limit := r.PageSize
+	if s := req.Form.Get(limitParam); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l < 1 {
+			return nil, 0, ErrInvalidLimit
+		}
+		limit = l
+	}
+	if limit > r.MaxPageSize {
+		limit = r.MaxPageSize
+	}
+
+	var c *cursor
+	if s := req.Form.Get(cursorParam); s != "" {
+		var err error
+		c, err = parseCursor(s)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return c, limit, nil
+}
+
+// Returns a link to the same resource positioned at c
+func pageLink(req *http.Request, c *cursor, limit int, rel string) string {
+	u := *req.URL
+	v := u.Query()
+	v.Set(cursorParam, c.String())
+	v.Set(limitParam, strconv.Itoa(limit))
+	u.RawQuery = v.Encode()
+	return fmt.Sprintf("<%s%s>; rel=\"%s\"", basePath(req), u.RequestURI(), rel)
+}
+
+// Removes the pagination params from a query string
+func withoutPaging(v url.Values) url.Values {
+	out := url.Values{}
+	for k, vs := range v {
+		if k == limitParam || k == cursorParam {
+			continue
+		}
+		out[k] = vs
+	}
+	return out
+}
+
+// Runs queries for the page the request asks for, encodes it and sets
+// the Link header for its neighbours. Queries are restricted to the
+// cursor position and, with a LimitQuerier, to the size of the page.
+// filter, if set, removes events the caller may not see.
+func (r *RESTService) writePage(w http.ResponseWriter, req *http.Request, queries []straumur.Query, filter func([]*straumur.Event) []*straumur.Event) (error, int) {
+
+	c, limit, err := r.getPaging(req)
+	if err != nil {
+		return err, http.StatusBadRequest
+	}
+
+	narrowed := make([]straumur.Query, len(queries))
+	for i, q := range queries {
+		if c != nil {
+			c.narrow(&q)
+		}
+		narrowed[i] = q
+	}
+
+	// Pages towards newer events need the ones closest to the cursor,
+	// which a newest first limit doesn't return
+	want := 0
+	if c == nil || !c.Prev {
+		want = limit + 1
+	}
+
+	var p page
+	for {
+		events, more, err := r.queryAll(req, narrowed, want)
+		if err != nil {
+			return err, http.StatusInternalServerError
+		}
+		events = withoutTombstones(events)
+		if filter != nil {
+			events = filter(events)
+		}
+		p = paginate(events, c, limit)
+		// Tombstones, filtered events and the cursor event itself may
+		// have made the page short
+		if p.Next != nil || !more {
+			break
+		}
+		want *= 2
+	}
+
+	// The query only reached one side of the cursor
+	if c != nil && len(p.Events) > 0 {
+		if c.Prev {
+			p.Next = cursorFor(p.Events[len(p.Events)-1], false)
+		} else {
+			p.Prev = cursorFor(p.Events[0], true)
+		}
+	}
+
+	links := []string{}
+	if p.Next != nil {
+		links = append(links, pageLink(req, p.Next, limit, "next"))
+	}
+	if p.Prev != nil {
+		links = append(links, pageLink(req, p.Prev, limit, "prev"))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.Encode(p.Events)
+	return nil, http.StatusOK
+}
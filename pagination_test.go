@@ -0,0 +1,206 @@
+package restservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Backend returning limited result sets, newest first, like a database
+// would and recording the queries it was asked for
+type limitedStore struct {
+	*straumur.LocalMemoryStore
+	queries []straumur.Query
+	limits  []int
+}
+
+func (s *limitedStore) QueryLimit(q straumur.Query, limit int) ([]*straumur.Event, error) {
+	s.queries = append(s.queries, q)
+	s.limits = append(s.limits, limit)
+	found, err := s.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	out := []*straumur.Event{}
+	for _, e := range found {
+		if (q.To.IsZero() || !e.Created.After(q.To)) && (q.From.IsZero() || !e.Created.Before(q.From)) {
+			out = append(out, e)
+		}
+	}
+	sort.Sort(byCreatedDesc(out))
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func makeEvents(n int) []*straumur.Event {
+	t := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := []*straumur.Event{}
+	for i := 1; i <= n; i++ {
+		e := straumur.Event{ID: i, Created: t.Add(time.Duration(i) * time.Minute)}
+		events = append(events, &e)
+	}
+	return events
+}
+
+func ids(events []*straumur.Event) []int {
+	out := []int{}
+	for _, e := range events {
+		out = append(out, e.ID)
+	}
+	return out
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+
+	c := &cursor{time.Unix(0, 1388534400000000123), 42, true}
+	parsed, err := parseCursor(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Created.Equal(c.Created) || parsed.ID != c.ID || parsed.Prev != c.Prev {
+		t.Errorf("Expected %+v, got %+v", c, parsed)
+	}
+
+	for _, s := range []string{"", "foo", "bjox", "eDoxOjI="} {
+		if _, err := parseCursor(s); err != ErrInvalidCursor {
+			t.Errorf("Expected ErrInvalidCursor for %q, got %v", s, err)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+
+	events := makeEvents(5)
+
+	p := paginate(events, nil, 2)
+	if fmt.Sprint(ids(p.Events)) != "[5 4]" {
+		t.Fatalf("Unexpected first page %v", ids(p.Events))
+	}
+	if p.Prev != nil || p.Next == nil {
+		t.Fatalf("Unexpected cursors %+v", p)
+	}
+
+	p = paginate(events, p.Next, 2)
+	if fmt.Sprint(ids(p.Events)) != "[3 2]" {
+		t.Fatalf("Unexpected second page %v", ids(p.Events))
+	}
+
+	last := paginate(events, p.Next, 2)
+	if fmt.Sprint(ids(last.Events)) != "[1]" || last.Next != nil {
+		t.Fatalf("Unexpected last page %v, next %+v", ids(last.Events), last.Next)
+	}
+
+	p = paginate(events, last.Prev, 2)
+	if fmt.Sprint(ids(p.Events)) != "[3 2]" {
+		t.Fatalf("Unexpected prev page %v", ids(p.Events))
+	}
+
+	p = paginate(events, p.Prev, 2)
+	if fmt.Sprint(ids(p.Events)) != "[5 4]" || p.Prev != nil {
+		t.Fatalf("Unexpected prev page %v, prev %+v", ids(p.Events), p.Prev)
+	}
+
+	if fmt.Sprint(ids(events)) != "[1 2 3 4 5]" {
+		t.Errorf("Expected the events to be left in order, got %v", ids(events))
+	}
+}
+
+func TestQueryPages(t *testing.T) {
+
+	d := &limitedStore{LocalMemoryStore: straumur.NewLocalMemoryStore()}
+	for _, e := range makeEvents(5) {
+		e.ID = 0
+		d.Save(e)
+	}
+	d.Save(NewTombstone(&straumur.Event{Created: time.Date(2014, 1, 1, 1, 0, 0, 0, time.UTC)}))
+
+	rest := NewRESTService(d, make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	get := func(path string) ([]int, map[string]string) {
+		r, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		events := []*straumur.Event{}
+		json.NewDecoder(r.Body).Decode(&events)
+		links := map[string]string{}
+		for _, link := range strings.Split(r.Header.Get("Link"), ", ") {
+			if parts := strings.Split(link, ">; rel="); len(parts) == 2 {
+				links[strings.Trim(parts[1], `"`)] = strings.TrimPrefix(parts[0], "<")
+			}
+		}
+		return ids(events), links
+	}
+
+	// The tombstone takes a place in the limited result
+	page, links := get("/api/search?limit=2")
+	if fmt.Sprint(page) != "[5 4]" || links["next"] == "" || links["prev"] != "" {
+		t.Fatalf("Unexpected first page %v %v", page, links)
+	}
+	if fmt.Sprint(d.limits) != "[3 6]" {
+		t.Errorf("Expected the limit to be passed on and raised for a short page, got %v", d.limits)
+	}
+
+	page, links = get(links["next"])
+	if fmt.Sprint(page) != "[3 2]" || links["prev"] == "" {
+		t.Fatalf("Unexpected second page %v %v", page, links)
+	}
+	if q := d.queries[len(d.queries)-1]; !q.To.Equal(time.Date(2014, 1, 1, 0, 4, 0, 0, time.UTC)) {
+		t.Errorf("Expected the query to end at the cursor, got %v", q.To)
+	}
+
+	last, links := get(links["next"])
+	if fmt.Sprint(last) != "[1]" || links["next"] != "" {
+		t.Fatalf("Unexpected last page %v %v", last, links)
+	}
+	if page, _ = get(links["prev"]); fmt.Sprint(page) != "[3 2]" {
+		t.Errorf("Unexpected prev page %v", page)
+	}
+
+	queries := len(d.queries)
+	get("/api/search?limit=-1")
+	if len(d.queries) != queries {
+		t.Errorf("Expected an invalid limit to be rejected before querying")
+	}
+}
+
+func TestSearchLinkHeader(t *testing.T) {
+	once.Do(startServer)
+
+	url := fmt.Sprintf("http://%s/search?key=myapp.user.login+OR+myapp.user.logout", serverAddr)
+	r, err := client.Get(url + "&limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("Wrong status code: %d", r.StatusCode)
+	}
+	if link := r.Header.Get("Link"); !strings.Contains(link, `rel="next"`) {
+		t.Errorf("Expected a next link, got %q", link)
+	}
+
+	r, err = client.Get(url + "&limit=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	if r.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected %d, got %d", http.StatusBadRequest, r.StatusCode)
+	}
+}
@@ -0,0 +1,362 @@
+package restservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/straumur/straumur"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+var (
+	ErrUnsupportedPatch = errors.New("Unsupported patch type, use " + mergePatchType + " or " + jsonPatchType)
+	ErrPatchTestFailed  = errors.New("Patch test operation failed")
+)
+
+// PATCH: /api/id/
+// Applies a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902) to
+// the stored event. Supports If-Match, patches of the same event are
+// applied one at a time and wait for the Ack so each one sees the
+// result of the previous. Without ?sync=true a patch that isn't
+// acknowledged within SyncTimeout is answered with 202.
+func (r *RESTService) patchHandler(w http.ResponseWriter, req *http.Request) (error, int) {
+	err, status := r.patch(w, req)
+	r.metrics.eventSaved(err, status)
+	return err, status
+}
+
+func (r *RESTService) patch(w http.ResponseWriter, req *http.Request) (error, int) {
+
+	vars := mux.Vars(req)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		return err, http.StatusBadRequest
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != mergePatchType && mediaType != jsonPatchType {
+		return ErrUnsupportedPatch, http.StatusUnsupportedMediaType
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err, http.StatusBadRequest
+	}
+
+	defer r.updates.lock(id)()
+
+	stored, err := r.backend(req).GetById(id)
+	if err != nil {
+		return err, http.StatusInternalServerError
+	}
+	if stored == nil {
+		return ErrNotFound, http.StatusNotFound
+	}
+	if err := PrincipalFrom(req).CheckWrite(stored); err != nil {
+		return err, http.StatusForbidden
+	}
+	if IsTombstone(stored) {
+		return ErrDeleted, http.StatusGone
+	}
+	if match := req.Header.Get("If-Match"); match != "" && !etagMatches(match, eventETag(stored), false) {
+		return ErrPreconditionFailed, http.StatusPreconditionFailed
+	}
+
+	e, err, status := applyPatch(stored, mediaType, body)
+	if err != nil {
+		return err, status
+	}
+	if e.ID != stored.ID {
+		return &ValidationError{[]FieldError{{"id", "may not be changed"}}}, http.StatusBadRequest
+	}
+	if err := checkKey(e); err != nil {
+		return err, http.StatusBadRequest
+	}
+	if err := r.Schemas.Validate(e); err != nil {
+		return err, http.StatusBadRequest
+	}
+	if err := PrincipalFrom(req).CheckWrite(e); err != nil {
+		return err, http.StatusForbidden
+	}
+	r.stampEvent(req, e)
+	r.traceEvent(req, e)
+
+	return r.syncSave(w, req, e)
+}
+
+// Returns stored with the patch applied
+func applyPatch(stored *straumur.Event, mediaType string, body []byte) (*straumur.Event, error, int) {
+
+	raw, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err, http.StatusInternalServerError
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err, http.StatusInternalServerError
+	}
+
+	if mediaType == mergePatchType {
+		var patch interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			return nil, err, http.StatusBadRequest
+		}
+		doc = mergePatch(doc, patch)
+	} else {
+		var ops []patchOp
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return nil, err, http.StatusBadRequest
+		}
+		for i, op := range ops {
+			if doc, err = op.apply(doc); err != nil {
+				if err == ErrPatchTestFailed {
+					return nil, err, http.StatusConflict
+				}
+				field := fmt.Sprintf("%d.%s", i, op.Op)
+				return nil, &ValidationError{[]FieldError{{field, err.Error()}}}, http.StatusBadRequest
+			}
+		}
+	}
+
+	if raw, err = json.Marshal(doc); err != nil {
+		return nil, err, http.StatusInternalServerError
+	}
+	var e straumur.Event
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, err, http.StatusBadRequest
+	}
+	return &e, nil, http.StatusOK
+}
+
+// Applies a merge patch, null removes a member and objects are merged
+// recursively
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// Single JSON Patch operation
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (op patchOp) value() (interface{}, error) {
+	if op.Value == nil {
+		return nil, errors.New("value is required")
+	}
+	var v interface{}
+	err := json.Unmarshal(op.Value, &v)
+	return v, err
+}
+
+func (op patchOp) apply(doc interface{}) (interface{}, error) {
+
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace":
+		v, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		return pointerSet(doc, path, v, op.Op == "add")
+	case "remove":
+		doc, _, err := pointerRemove(doc, path)
+		return doc, err
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, errors.New("can't move a value into itself")
+			}
+			if doc, v, err = pointerRemove(doc, from); err != nil {
+				return nil, err
+			}
+		} else {
+			if v, err = pointerGet(doc, from); err != nil {
+				return nil, err
+			}
+			// Copy so later operations don't change both values
+			b, _ := json.Marshal(v)
+			json.Unmarshal(b, &v)
+		}
+		return pointerSet(doc, path, v, true)
+	case "test":
+		v, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		current, err := pointerGet(doc, path)
+		if err != nil || !reflect.DeepEqual(current, v) {
+			return nil, ErrPatchTestFailed
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// Splits a JSON Pointer (RFC 6901) into unescaped reference tokens
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("invalid pointer %q", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// Returns the array index of token, end allows len(a) and "-"
+func arrayIndex(a []interface{}, token string, end bool) (int, error) {
+	if end && token == "-" {
+		return len(a), nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > len(a) || (i == len(a) && !end) || (token != "0" && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[token]
+			if !ok {
+				return nil, fmt.Errorf("%q not found", token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(c, token, false)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, fmt.Errorf("%q not found", token)
+		}
+	}
+	return doc, nil
+}
+
+// Sets the value at path, add inserts into arrays and creates object
+// members while replace requires the value to exist
+func pointerSet(doc interface{}, path []string, v interface{}, add bool) (interface{}, error) {
+
+	if len(path) == 0 {
+		return v, nil
+	}
+	token, last := path[0], len(path) == 1
+
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[token]
+		if last {
+			if !ok && !add {
+				return nil, fmt.Errorf("%q not found", token)
+			}
+			c[token] = v
+			return c, nil
+		}
+		if !ok {
+			return nil, fmt.Errorf("%q not found", token)
+		}
+		child, err := pointerSet(child, path[1:], v, add)
+		c[token] = child
+		return c, err
+	case []interface{}:
+		i, err := arrayIndex(c, token, last && add)
+		if err != nil {
+			return nil, err
+		}
+		if !last {
+			child, err := pointerSet(c[i], path[1:], v, add)
+			c[i] = child
+			return c, err
+		}
+		if !add {
+			c[i] = v
+			return c, nil
+		}
+		c = append(c, nil)
+		copy(c[i+1:], c[i:])
+		c[i] = v
+		return c, nil
+	}
+	return nil, fmt.Errorf("%q not found", token)
+}
+
+// Removes the value at path and returns it
+func pointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+
+	if len(path) == 0 {
+		return nil, nil, errors.New("can't remove the whole event")
+	}
+	token, last := path[0], len(path) == 1
+
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("%q not found", token)
+		}
+		if last {
+			delete(c, token)
+			return c, child, nil
+		}
+		child, removed, err := pointerRemove(child, path[1:])
+		c[token] = child
+		return c, removed, err
+	case []interface{}:
+		i, err := arrayIndex(c, token, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if last {
+			removed := c[i]
+			return append(c[:i], c[i+1:]...), removed, nil
+		}
+		child, removed, err := pointerRemove(c[i], path[1:])
+		c[i] = child
+		return c, removed, err
+	}
+	return nil, nil, fmt.Errorf("%q not found", token)
+}
@@ -0,0 +1,187 @@
+package restservice
+
+import (
+	"encoding/json"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONPatchOps(t *testing.T) {
+
+	for _, c := range []struct {
+		doc, ops, expected string
+	}{
+		{`{"tags": ["a"]}`, `[{"op": "add", "path": "/tags/-", "value": "b"}]`, `{"tags": ["a", "b"]}`},
+		{`{"tags": ["a", "c"]}`, `[{"op": "add", "path": "/tags/1", "value": "b"}]`, `{"tags": ["a", "b", "c"]}`},
+		{`{"tags": ["a", "b"]}`, `[{"op": "remove", "path": "/tags/0"}]`, `{"tags": ["b"]}`},
+		{`{"key": "a"}`, `[{"op": "replace", "path": "/key", "value": "b"}]`, `{"key": "b"}`},
+		{`{"a/b": {"~": 1}}`, `[{"op": "move", "from": "/a~1b/~0", "path": "/c"}]`, `{"a/b": {}, "c": 1}`},
+		{`{"a": [1]}`, `[{"op": "copy", "from": "/a", "path": "/b"}, {"op": "add", "path": "/b/-", "value": 2}]`, `{"a": [1], "b": [1, 2]}`},
+		{`{"a": 1}`, `[{"op": "test", "path": "/a", "value": 1}]`, `{"a": 1}`},
+	} {
+		var doc, expected interface{}
+		var ops []patchOp
+		json.Unmarshal([]byte(c.doc), &doc)
+		json.Unmarshal([]byte(c.ops), &ops)
+		json.Unmarshal([]byte(c.expected), &expected)
+		var err error
+		for _, op := range ops {
+			if doc, err = op.apply(doc); err != nil {
+				break
+			}
+		}
+		if err != nil || !reflect.DeepEqual(doc, expected) {
+			t.Errorf("Applying %s to %s, expected %s, got %v %v", c.ops, c.doc, c.expected, doc, err)
+		}
+	}
+
+	for _, ops := range []string{
+		`[{"op": "replace", "path": "/missing", "value": 1}]`,
+		`[{"op": "remove", "path": "/tags/5"}]`,
+		`[{"op": "add", "path": "/tags/01", "value": 1}]`,
+		`[{"op": "add", "path": "tags", "value": 1}]`,
+		`[{"op": "add", "path": "/tags/-"}]`,
+		`[{"op": "move", "from": "/tags", "path": "/tags/0"}]`,
+		`[{"op": "frobnicate", "path": "/tags"}]`,
+	} {
+		var doc interface{}
+		var op []patchOp
+		json.Unmarshal([]byte(`{"tags": ["a"]}`), &doc)
+		json.Unmarshal([]byte(ops), &op)
+		if _, err := op[0].apply(doc); err == nil {
+			t.Errorf("Expected %s to fail", ops)
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+
+	var target, patch, expected interface{}
+	json.Unmarshal([]byte(`{"a": "b", "c": {"d": "e", "f": "g"}, "tags": ["x"]}`), &target)
+	json.Unmarshal([]byte(`{"a": "z", "c": {"f": null}, "tags": ["y"]}`), &patch)
+	json.Unmarshal([]byte(`{"a": "z", "c": {"d": "e"}, "tags": ["y"]}`), &expected)
+
+	if result := mergePatch(target, patch); !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
+
+func TestPatchHandler(t *testing.T) {
+
+	d := straumur.NewLocalMemoryStore()
+	d.Save(&straumur.Event{Key: "patch", Origin: "myapp", Actors: []string{"user/1"}, Tags: []string{"open"}})
+
+	rest := NewRESTService(d, make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	go func() {
+		for e := range rest.Updates() {
+			rest.Ack(e, d.Save(e))
+		}
+	}()
+
+	path := "/api/1/?sync=true"
+	patch := func(contentType, body string, header ...string) *http.Response {
+		req, _ := http.NewRequest("PATCH", server.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		if len(header) == 2 {
+			req.Header.Set(header[0], header[1])
+		}
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r
+	}
+
+	if r := patch(mergePatchType, `{"tags": ["closed"], "actors": null}`); r.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, r.StatusCode)
+	}
+	e, _ := d.GetById(1)
+	if e.Key != "patch" || !reflect.DeepEqual(e.Tags, []string{"closed"}) || e.Actors != nil {
+		t.Errorf("Unexpected event after merge patch %+v", e)
+	}
+
+	if r := patch(jsonPatchType, `[{"op": "add", "path": "/actors", "value": ["user/2"]}]`); r.StatusCode != http.StatusOK {
+		t.Fatalf("Expected %d, got %d", http.StatusOK, r.StatusCode)
+	}
+	e, _ = d.GetById(1)
+	if !reflect.DeepEqual(e.Actors, []string{"user/2"}) || !reflect.DeepEqual(e.Tags, []string{"closed"}) {
+		t.Errorf("Unexpected event after JSON patch %+v", e)
+	}
+
+	for _, c := range []struct {
+		contentType, body string
+		header            []string
+		status            int
+	}{
+		{"application/json", `{"tags": []}`, nil, http.StatusUnsupportedMediaType},
+		{mergePatchType, `{"id": 2}`, nil, http.StatusBadRequest},
+		{mergePatchType, `{"importance": "high"}`, nil, http.StatusBadRequest},
+		{jsonPatchType, `[{"op": "test", "path": "/key", "value": "other"}]`, nil, http.StatusConflict},
+		{mergePatchType, `{"tags": []}`, []string{"If-Match", `"stale"`}, http.StatusPreconditionFailed},
+	} {
+		if r := patch(c.contentType, c.body, c.header...); r.StatusCode != c.status {
+			t.Errorf("Expected %d for %s, got %d", c.status, c.body, r.StatusCode)
+		}
+	}
+	// Patches are always saved before responding, so the second one
+	// applies on top of the first even without ?sync=true
+	path = "/api/1/"
+	patch(mergePatchType, `{"tags": ["reopened"]}`)
+	patch(mergePatchType, `{"actors": ["user/3"]}`)
+	e, _ = d.GetById(1)
+	if !reflect.DeepEqual(e.Tags, []string{"reopened"}) || !reflect.DeepEqual(e.Actors, []string{"user/3"}) {
+		t.Errorf("Expected both patches to be stored, got %+v", e)
+	}
+}
+
+func TestPatchWithoutAck(t *testing.T) {
+
+	d := straumur.NewLocalMemoryStore()
+	d.Save(&straumur.Event{Key: "patch", Origin: "myapp"})
+
+	rest := NewRESTService(d, make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.SyncTimeout = 50 * time.Millisecond
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	// A consumer that saves without calling Ack
+	go func() {
+		for e := range rest.Updates() {
+			d.Save(e)
+		}
+	}()
+
+	patch := func(query string) int {
+		req, _ := http.NewRequest("PATCH", server.URL+"/api/1/"+query, strings.NewReader(`{"description": "patched"}`))
+		req.Header.Set("Content-Type", mergePatchType)
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r.StatusCode
+	}
+
+	if status := patch(""); status != http.StatusAccepted {
+		t.Errorf("Expected an unconfirmed patch to be accepted, got %d", status)
+	}
+	if stored, _ := d.GetById(1); stored.Description != "patched" {
+		t.Errorf("Expected the patch to be saved, got %+v", stored)
+	}
+	// Callers asking for a confirmed save still learn it timed out
+	if status := patch("?sync=true"); status != http.StatusGatewayTimeout {
+		t.Errorf("Expected %d, got %d", http.StatusGatewayTimeout, status)
+	}
+}
@@ -0,0 +1,138 @@
+package restservice
+
+import (
+	"errors"
+	"github.com/straumur/straumur"
+	"strings"
+)
+
+var (
+	ErrOriginForbidden = errors.New("Origin not allowed")
+	ErrEntityForbidden = errors.New("Entity not allowed")
+	ErrEntityRequired  = errors.New("Query must be restricted to allowed entities")
+)
+
+// Authorization rules are kept on the Principal, see the Origins and
+// Entities fields. A nil principal, i.e. authentication is disabled,
+// is unrestricted.
+
+// Reports whether entity matches pattern, patterns ending in * match
+// by prefix
+func matchEntity(pattern, entity string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(entity, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == entity
+}
+
+func (p *Principal) restricted() bool {
+	return p != nil && len(p.Entities) > 0
+}
+
+// Reports whether the principal may post events with origin
+func (p *Principal) CanWriteOrigin(origin string) bool {
+	if p == nil || len(p.Origins) == 0 {
+		return true
+	}
+	for _, o := range p.Origins {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the principal may query or subscribe to entity
+func (p *Principal) CanReadEntity(entity string) bool {
+	if !p.restricted() {
+		return true
+	}
+	for _, pattern := range p.Entities {
+		if matchEntity(pattern, entity) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the principal may see e, which requires one of its
+// entities to be allowed
+func (p *Principal) CanRead(e *straumur.Event) bool {
+	if !p.restricted() {
+		return true
+	}
+	for _, entity := range e.Entities {
+		if p.CanReadEntity(entity) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the principal may write e. Principals restricted to entities
+// may only write events whose entities are all allowed, so they can
+// read what they write and can't reach the subscribers of others.
+func (p *Principal) CheckWrite(e *straumur.Event) error {
+	if !p.CanWriteOrigin(e.Origin) {
+		return ErrOriginForbidden
+	}
+	if !p.restricted() {
+		return nil
+	}
+	if len(e.Entities) == 0 {
+		return ErrEntityForbidden
+	}
+	for _, entity := range e.Entities {
+		if !p.CanReadEntity(entity) {
+			return ErrEntityForbidden
+		}
+	}
+	return nil
+}
+
+// Checks the entities of q are allowed
+func (p *Principal) CheckQuery(q *straumur.Query) error {
+	for _, entity := range q.Entities {
+		if !p.CanReadEntity(entity) {
+			return ErrEntityForbidden
+		}
+	}
+	return nil
+}
+
+// Checks q and returns the queries to run for it. Events match every
+// entity of a query, so queries without entities are run once per
+// entity of a restricted principal. Patterns can't be queried, with
+// those q is returned as is and the results have to be filtered.
+func (p *Principal) ScopeQuery(q *straumur.Query) ([]straumur.Query, error) {
+	if err := p.CheckQuery(q); err != nil {
+		return nil, err
+	}
+	if !p.restricted() || len(q.Entities) > 0 {
+		return []straumur.Query{*q}, nil
+	}
+	queries := make([]straumur.Query, 0, len(p.Entities))
+	for _, entity := range p.Entities {
+		if strings.HasSuffix(entity, "*") {
+			return []straumur.Query{*q}, nil
+		}
+		scoped := *q
+		scoped.Entities = []string{entity}
+		queries = append(queries, scoped)
+	}
+	return queries, nil
+}
+
+// Removes the events the principal may not see
+func (p *Principal) Filter(events []*straumur.Event) []*straumur.Event {
+	if !p.restricted() {
+		return events
+	}
+	out := make([]*straumur.Event, 0, len(events))
+	for _, e := range events {
+		if p.CanRead(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
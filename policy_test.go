@@ -0,0 +1,152 @@
+package restservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrincipalPolicy(t *testing.T) {
+
+	var anonymous *Principal
+	teamA := &Principal{
+		Name:     "teama",
+		Origins:  []string{"teama"},
+		Entities: []string{"teama/*", "shared/dashboard"},
+	}
+
+	mine := &straumur.Event{Origin: "teama", Entities: []string{"teama/user/1"}}
+	theirs := &straumur.Event{Origin: "teamb", Entities: []string{"teamb/user/1"}}
+	shared := &straumur.Event{Origin: "teamb", Entities: []string{"teamb/user/1", "shared/dashboard"}}
+
+	if anonymous.CheckWrite(theirs) != nil || !anonymous.CanRead(theirs) {
+		t.Errorf("A nil principal should be unrestricted")
+	}
+	if teamA.CheckWrite(mine) != nil || teamA.CheckWrite(theirs) != ErrOriginForbidden {
+		t.Errorf("Unexpected write permissions for %+v", teamA)
+	}
+	for _, entities := range [][]string{nil, {"teama/user/1", "teamb/user/1"}} {
+		if err := teamA.CheckWrite(&straumur.Event{Origin: "teama", Entities: entities}); err != ErrEntityForbidden {
+			t.Errorf("Expected %v for %v, got %v", ErrEntityForbidden, entities, err)
+		}
+	}
+	if !teamA.CanRead(mine) || teamA.CanRead(theirs) || !teamA.CanRead(shared) {
+		t.Errorf("Unexpected read permissions for %+v", teamA)
+	}
+	if teamA.CanReadEntity("shared/dashboard/2") {
+		t.Errorf("Patterns without * should match exactly")
+	}
+
+	if err := teamA.CheckQuery(&straumur.Query{Entities: []string{"teama/user/1"}}); err != nil {
+		t.Errorf("Unexpected %v", err)
+	}
+	if err := teamA.CheckQuery(&straumur.Query{Entities: []string{"teamb/user/1"}}); err != ErrEntityForbidden {
+		t.Errorf("Expected %v, got %v", ErrEntityForbidden, err)
+	}
+
+	events := teamA.Filter([]*straumur.Event{mine, theirs, shared})
+	if len(events) != 2 || events[0] != mine || events[1] != shared {
+		t.Errorf("Unexpected %+v", events)
+	}
+
+	teamB := &Principal{Name: "teamb", Entities: []string{"teamb/user/1", "shared/dashboard"}}
+	queries, err := teamB.ScopeQuery(&straumur.Query{Key: "a"})
+	if err != nil || len(queries) != 2 || queries[0].Entities[0] != "teamb/user/1" || queries[1].Entities[0] != "shared/dashboard" || queries[1].Key != "a" {
+		t.Errorf("Expected a query per entity, got %+v %v", queries, err)
+	}
+	if queries, _ := teamA.ScopeQuery(&straumur.Query{}); len(queries) != 1 || len(queries[0].Entities) != 0 {
+		t.Errorf("Expected patterns to leave the query as is, got %+v", queries)
+	}
+}
+
+func TestPolicyRoutes(t *testing.T) {
+
+	d := straumur.NewLocalMemoryStore()
+	d.Save(&straumur.Event{Key: "a", Origin: "teama", Entities: []string{"teama/user/1"}})
+	d.Save(&straumur.Event{Key: "b", Origin: "teamb", Entities: []string{"teamb/user/1"}})
+	d.Save(&straumur.Event{Key: "c", Origin: "teama", Entities: []string{"teamb/user/1"}})
+	d.Save(NewTombstone(&straumur.Event{Key: "d", Origin: "teamb", Entities: []string{"teamb/user/1"}}))
+
+	keys := NewMemoryKeyStore()
+	keys.Add("teama-key", &Principal{
+		Name:     "teama",
+		Scopes:   []string{ScopeAll},
+		Origins:  []string{"teama"},
+		Entities: []string{"teama/*"},
+	})
+	keys.Add("teamb-key", &Principal{
+		Name:     "teamb",
+		Scopes:   []string{ScopeAll},
+		Entities: []string{"teamb/user/1"},
+	})
+
+	rest := NewRESTService(d, make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.Auth = NewAPIKeyAuthenticator(keys)
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	key := "teama-key"
+	do := func(method, path string, body interface{}) *http.Response {
+		buf, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, server.URL+path, bytes.NewReader(buf))
+		req.Header.Set(apiKeyHeader, key)
+		r, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := do("GET", "/api/search", nil)
+	events := []straumur.Event{}
+	json.NewDecoder(r.Body).Decode(&events)
+	r.Body.Close()
+	if len(events) != 1 || events[0].Key != "a" {
+		t.Errorf("Expected only team A events, got %+v", events)
+	}
+
+	tests := []struct {
+		Method string
+		Path   string
+		Body   interface{}
+		Status int
+	}{
+		{"GET", "/api/teamb/user/", nil, http.StatusForbidden},
+		{"GET", "/api/2/", nil, http.StatusForbidden},
+		{"GET", "/api/aggregate/actors", nil, http.StatusForbidden},
+		{"GET", "/api/4/", nil, http.StatusForbidden},
+		{"POST", "/api/", straumur.Event{Key: "c", Origin: "teamb", Entities: []string{"teama/user/2"}}, http.StatusForbidden},
+		{"POST", "/api/", straumur.Event{Key: "c", Origin: "teama", Entities: []string{"teamb/user/2"}}, http.StatusForbidden},
+		{"POST", "/api/", straumur.Event{Key: "c", Origin: "teama", Entities: []string{"teama/user/2"}}, http.StatusCreated},
+		{"PUT", "/api/2/", straumur.Event{ID: 2, Key: "b", Origin: "teama", Entities: []string{"teama/user/1"}}, http.StatusForbidden},
+		{"PUT", "/api/1/", straumur.Event{ID: 1, Key: "a", Origin: "teama", Entities: []string{"teamb/user/1"}}, http.StatusForbidden},
+		{"PUT", "/api/3/", straumur.Event{ID: 3, Key: "c", Origin: "teama", Entities: []string{"teama/user/1"}}, http.StatusForbidden},
+		{"DELETE", "/api/2/", nil, http.StatusForbidden},
+		{"DELETE", "/api/3/", nil, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := do(test.Method, test.Path, test.Body)
+		r.Body.Close()
+		if r.StatusCode != test.Status {
+			t.Errorf("%s %s: expected %d, got %d", test.Method, test.Path, test.Status, r.StatusCode)
+		}
+	}
+	// Queries of a principal with a single entity are restricted to it
+	key = "teamb-key"
+	r = do("GET", "/api/search", nil)
+	events = []straumur.Event{}
+	json.NewDecoder(r.Body).Decode(&events)
+	r.Body.Close()
+	if len(events) != 2 || events[0].Key != "c" || events[1].Key != "b" {
+		t.Errorf("Expected the team B entity events, got %+v", events)
+	}
+	if r := do("GET", "/api/aggregate/actors", nil); r.StatusCode != http.StatusOK {
+		t.Errorf("Expected the aggregate to be restricted to the entity, got %d", r.StatusCode)
+	}
+}
@@ -0,0 +1,90 @@
+package restservice
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/straumur/straumur"
+	"net/http"
+)
+
+// Commands accepted over the websocket connection
+const (
+	CommandSubscribe   = "subscribe"
+	CommandUnsubscribe = "unsubscribe"
+	CommandList        = "list"
+)
+
+// Types of messages sent over the websocket connection
+const (
+	MessageEvent         = "event"
+	MessageSubscribed    = "subscribed"
+	MessageUnsubscribed  = "unsubscribed"
+	MessageSubscriptions = "subscriptions"
+	MessageError         = "error"
+)
+
+const MaxSubscriptions = 32
+
+var (
+	ErrUnknownCommand      = errors.New("Unknown command")
+	ErrMissingSubscription = errors.New("Missing subscription id")
+	ErrMissingQuery        = errors.New("Missing subscription query")
+	ErrUnknownSubscription = errors.New("Unknown subscription")
+	ErrTooManySubscription = errors.New("Too many subscriptions")
+)
+
+// A control message sent by a websocket client, e.g.
+//
+//	{"command": "subscribe", "id": "logins", "query": {...}}
+//	{"command": "subscribe", "id": "logins", "query": {...}, "since": 42}
+//	{"command": "unsubscribe", "id": "logins"}
+//	{"command": "list"}
+type Command struct {
+	Command string          `json:"command"`
+	Id      string          `json:"id,omitempty"`
+	Query   *straumur.Query `json:"query,omitempty"`
+	// Replay broadcasts matching the query sent after this event id
+	Since *int `json:"since,omitempty"`
+}
+
+// A message sent to a websocket client that uses subscriptions
+type Message struct {
+	Type          string                    `json:"type"`
+	Id            string                    `json:"id,omitempty"`
+	Subscriptions []string                  `json:"subscriptions,omitempty"`
+	Queries       map[string]straumur.Query `json:"queries,omitempty"`
+	Event         *straumur.Event           `json:"event,omitempty"`
+	Code          string                    `json:"code,omitempty"`
+	Error         string                    `json:"error,omitempty"`
+	// Events replayed on subscribe, Truncated is set when some events
+	// since the requested id are no longer in the broadcast history
+	Events    []*straumur.Event `json:"events,omitempty"`
+	Truncated bool              `json:"truncated,omitempty"`
+}
+
+func errorMessage(id string, err error) *Message {
+	code := statusErrorCode(err, http.StatusBadRequest)
+	return &Message{Type: MessageError, Id: id, Code: code, Error: err.Error()}
+}
+
+// Parses an incoming message. Messages without a command are plain
+// queries replacing the client filter, as sent by older clients.
+func parseCommand(raw json.RawMessage) (*Command, *straumur.Query, error) {
+
+	var probe struct {
+		Command string `json:"command"`
+	}
+	if err := json.Unmarshal(raw, &probe); err == nil && probe.Command != "" {
+		var cmd Command
+		if err := json.Unmarshal(raw, &cmd); err != nil {
+			return nil, nil, err
+		}
+		return &cmd, nil, nil
+	}
+
+	var q straumur.Query
+	if err := json.Unmarshal(raw, &q); err != nil {
+		return nil, nil, err
+	}
+	return nil, &q, nil
+}
@@ -0,0 +1,26 @@
+package restservice
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+
+	cmd, q, err := parseCommand(json.RawMessage(`{"command": "subscribe", "id": "a", "query": {"key": "foo"}}`))
+	if err != nil || q != nil || cmd == nil {
+		t.Fatalf("Unexpected %+v, %+v, %v", cmd, q, err)
+	}
+	if cmd.Id != "a" || cmd.Query == nil || cmd.Query.Key != "foo" {
+		t.Errorf("Unexpected command %+v", cmd)
+	}
+
+	cmd, q, err = parseCommand(json.RawMessage(`{"key": "foo"}`))
+	if err != nil || cmd != nil || q == nil || q.Key != "foo" {
+		t.Errorf("Expected a plain query, got %+v, %+v, %v", cmd, q, err)
+	}
+
+	if _, _, err = parseCommand(json.RawMessage(`{"command": "subscribe", "query": 1}`)); err == nil {
+		t.Errorf("Expected an error for an invalid command")
+	}
+}
@@ -0,0 +1,519 @@
+package restservice
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/straumur/straumur"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultQueueSize = 10000
+	walName          = "ingest.wal"
+	// Acks written before the log is rewritten without them
+	walCompactAfter = 10000
+	// Delay before an event that failed to save is delivered again,
+	// doubled on every failure
+	redeliverDelay    = 100 * time.Millisecond
+	maxRedeliverDelay = 30 * time.Second
+	// Failed saves after which an event is logged as a dead letter
+	// and dropped
+	maxSaveAttempts = 10
+)
+
+var (
+	ErrQueueFull = errors.New("Ingest queue is full")
+)
+
+// Line of the write-ahead log, puts carry the event and acks remove it
+type walRecord struct {
+	Op    string          `json:"op"`
+	Seq   uint64          `json:"seq"`
+	Event json.RawMessage `json:"event,omitempty"`
+}
+
+type queueItem struct {
+	seq   uint64
+	event *straumur.Event
+	// Encoded when the event was queued, consumers may modify event
+	raw json.RawMessage
+	// Failed saves and when the event may be delivered again
+	failures  int
+	notBefore time.Time
+}
+
+// Bounded queue between the handlers and Updates(). A single
+// dispatcher delivers events in order. When a write-ahead log is open
+// delivered events are kept until they are acknowledged and events
+// left over by a crash are redelivered on the next start.
+type ingestQueue struct {
+	mu sync.Mutex
+	// Not yet delivered, oldest first
+	pending []*queueItem
+	// Failed to save and backing off, kept apart so they don't hold
+	// up pending
+	retrying []*queueItem
+	// Delivered and waiting for Ack, only used with a log
+	inflight map[*straumur.Event]*queueItem
+	// Taken by the dispatcher and not yet read from Updates()
+	sending *queueItem
+	seq     uint64
+	wal     *os.File
+	path    string
+	// Length of the log up to the last complete record
+	walSize int64
+	acked   int
+	closed  bool
+	metrics *metrics
+
+	wake     chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	drain    sync.Once
+	drainErr error
+}
+
+func newIngestQueue(m *metrics) *ingestQueue {
+	return &ingestQueue{
+		inflight: make(map[*straumur.Event]*queueItem),
+		metrics:  m,
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (q *ingestQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Opens or creates the log in dir and queues the events it holds that
+// were never acknowledged
+func (q *ingestQueue) open(dir string) error {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.wal != nil {
+		return errors.New("write-ahead log is already open")
+	}
+	if q.seq > 0 {
+		return errors.New("write-ahead log must be opened before events are queued")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	q.path = filepath.Join(dir, walName)
+
+	puts := make(map[uint64]json.RawMessage)
+	if f, err := os.Open(q.path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var rec walRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				// A torn write at the end of the log
+				logger.Warningf("Skipping corrupt write-ahead log record: %v", err)
+				continue
+			}
+			if rec.Op == "put" {
+				puts[rec.Seq] = rec.Event
+			} else {
+				delete(puts, rec.Seq)
+			}
+			if rec.Seq > q.seq {
+				q.seq = rec.Seq
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	seqs := make([]uint64, 0, len(puts))
+	for seq := range puts {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	recovered := make([]*queueItem, 0, len(seqs))
+	for _, seq := range seqs {
+		e := &straumur.Event{}
+		if err := json.Unmarshal(puts[seq], e); err != nil {
+			return err
+		}
+		recovered = append(recovered, &queueItem{seq: seq, event: e, raw: puts[seq]})
+	}
+	if len(recovered) > 0 {
+		logger.Infof("Redelivering %d events from %s", len(recovered), q.path)
+	}
+	q.pending = recovered
+	q.metrics.queued(len(recovered))
+
+	if err := q.compact(); err != nil {
+		return err
+	}
+	q.signal()
+	return nil
+}
+
+// Rewrites the log with the events not yet acknowledged, q.mu must be
+// held
+func (q *ingestQueue) compact() error {
+
+	items := make([]*queueItem, 0, len(q.pending)+len(q.retrying)+len(q.inflight))
+	items = append(items, q.pending...)
+	items = append(items, q.retrying...)
+	for _, item := range q.inflight {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].seq < items[j].seq })
+
+	tmp := q.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, item := range items {
+		if err := enc.Encode(walRecord{"put", item.seq, item.raw}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if q.wal != nil {
+		q.wal.Close()
+		q.wal = nil
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return err
+	}
+	if q.wal, err = os.OpenFile(q.path, os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return err
+	}
+	st, err := q.wal.Stat()
+	if err != nil {
+		return err
+	}
+	q.walSize = st.Size()
+	q.acked = 0
+	return nil
+}
+
+// Appends whole records to the log, a partial write is truncated so
+// the next record doesn't end up on the torn line. q.mu must be held.
+func (q *ingestQueue) appendLog(buf []byte) error {
+	n, err := q.wal.Write(buf)
+	if err != nil {
+		if n > 0 {
+			if terr := q.wal.Truncate(q.walSize); terr != nil {
+				logger.Errorf("Unable to truncate torn record in %s: %v", q.path, terr)
+			}
+		}
+		return err
+	}
+	q.walSize += int64(n)
+	return nil
+}
+
+// Queues events, all or none. Fails with ErrQueueFull when fewer than
+// len(events) slots of size are free.
+func (q *ingestQueue) push(size int, events ...*straumur.Event) error {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrShuttingDown
+	}
+	if q.held()+len(events) > size {
+		return ErrQueueFull
+	}
+
+	items := make([]*queueItem, len(events))
+	var buf []byte
+	for i, e := range events {
+		items[i] = &queueItem{seq: q.seq + uint64(i) + 1, event: e}
+		if q.wal == nil {
+			continue
+		}
+		raw, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		items[i].raw = raw
+		line, _ := json.Marshal(walRecord{"put", items[i].seq, raw})
+		buf = append(append(buf, line...), '\n')
+	}
+
+	if q.wal != nil {
+		if err := q.appendLog(buf); err != nil {
+			return err
+		}
+		if err := q.wal.Sync(); err != nil {
+			return err
+		}
+	}
+
+	q.seq += uint64(len(events))
+	q.pending = append(q.pending, items...)
+	q.metrics.queued(len(items))
+	q.signal()
+	return nil
+}
+
+// Returns the number of events taking up room in the queue, q.mu must
+// be held
+func (q *ingestQueue) held() int {
+	n := len(q.pending) + len(q.retrying) + len(q.inflight)
+	if q.sending != nil && q.wal == nil {
+		n++
+	}
+	return n
+}
+
+// Takes a failed event whose backoff is over, or else the oldest
+// pending one, for delivery. It is registered as in flight up front as
+// the consumer may Ack it as soon as it is read. Returns how long to
+// wait when only events backing off are left.
+func (q *ingestQueue) take() (*queueItem, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var item *queueItem
+	var wait time.Duration
+	now := time.Now()
+	for i, retry := range q.retrying {
+		d := retry.notBefore.Sub(now)
+		if d <= 0 {
+			item = retry
+			q.retrying = append(q.retrying[:i], q.retrying[i+1:]...)
+			break
+		}
+		if wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	if item == nil {
+		if len(q.pending) == 0 {
+			return nil, wait
+		}
+		item = q.pending[0]
+		q.pending = q.pending[1:]
+	}
+	if q.wal != nil {
+		q.inflight[item.event] = item
+	}
+	q.sending = item
+	return item, 0
+}
+
+func (q *ingestQueue) delivered() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sending = nil
+	q.metrics.queued(-1)
+}
+
+// Puts back an event whose delivery was interrupted
+func (q *ingestQueue) untake(item *queueItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.inflight, item.event)
+	if item.failures > 0 {
+		q.retrying = append([]*queueItem{item}, q.retrying...)
+	} else {
+		q.pending = append([]*queueItem{item}, q.pending...)
+	}
+	q.sending = nil
+}
+
+// Delivers queued events to events until stopped
+func (q *ingestQueue) run(events chan<- *straumur.Event) {
+	defer close(q.done)
+	for {
+		item, wait := q.take()
+		if item == nil {
+			var retry <-chan time.Time
+			if wait > 0 {
+				retry = time.After(wait)
+			}
+			select {
+			case <-q.wake:
+				continue
+			case <-retry:
+				continue
+			case <-q.quit:
+				return
+			}
+		}
+		select {
+		case events <- item.event:
+			q.delivered()
+		case <-q.quit:
+			q.untake(item)
+			return
+		}
+	}
+}
+
+// Returns how long an event that failed to save failures times
+// waits before it is delivered again
+func backoff(failures int) time.Duration {
+	d := redeliverDelay
+	for i := 1; i < failures && d < maxRedeliverDelay; i++ {
+		d *= 2
+	}
+	if d > maxRedeliverDelay {
+		d = maxRedeliverDelay
+	}
+	return d
+}
+
+// Removes an acknowledged event. Events acknowledged with an error
+// are delivered again after a backoff when redeliver is set, up to
+// maxSaveAttempts times, else they are dropped as the submitter has
+// been told about the failure.
+func (q *ingestQueue) ack(e *straumur.Event, err error, redeliver bool) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.inflight[e]
+	if !ok {
+		return
+	}
+	delete(q.inflight, e)
+
+	if err != nil && redeliver {
+		item.failures++
+		if item.failures >= maxSaveAttempts {
+			logger.Errorf("Dead letter, dropping event %d after %d failed saves: %v: %s", item.seq, item.failures, err, item.raw)
+		} else {
+			delay := backoff(item.failures)
+			item.notBefore = time.Now().Add(delay)
+			logger.Warningf("Redelivering event %d in %v after failed save: %v", item.seq, delay, err)
+			q.retrying = append(q.retrying, item)
+			q.metrics.queued(1)
+			q.signal()
+			return
+		}
+	}
+
+	if q.wal == nil {
+		return
+	}
+	line, _ := json.Marshal(walRecord{Op: "ack", Seq: item.seq})
+	if err := q.appendLog(append(line, '\n')); err != nil {
+		logger.Errorf("Unable to write ack to %s: %v", q.path, err)
+	}
+	q.acked++
+	if q.acked >= walCompactAfter {
+		if err := q.compact(); err != nil {
+			logger.Errorf("Unable to compact %s: %v", q.path, err)
+		}
+	}
+}
+
+// Returns the number of events shutdown waits for, events backing
+// off after a failed save are kept in the log
+func (q *ingestQueue) undelivered() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.pending)
+	if q.sending != nil {
+		n++
+	}
+	return n
+}
+
+func (q *ingestQueue) isClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// Stops the dispatcher, compacts the log and closes it
+func (q *ingestQueue) stop() {
+	q.stopOnce.Do(func() {
+		close(q.quit)
+		<-q.done
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.wal != nil {
+			if err := q.compact(); err != nil {
+				logger.Errorf("Unable to compact %s: %v", q.path, err)
+			}
+			q.wal.Close()
+			q.wal = nil
+		}
+	})
+}
+
+// Refuses new events, waits for queued ones to be delivered and
+// closes events. Events still queued when ctx is done are dropped, or
+// left in the log when there is one.
+func (q *ingestQueue) shutdown(ctx context.Context, events chan *straumur.Event) error {
+	q.drain.Do(func() {
+		q.mu.Lock()
+		q.closed = true
+		q.mu.Unlock()
+
+		tick := time.NewTicker(10 * time.Millisecond)
+		defer tick.Stop()
+		for q.undelivered() > 0 && q.drainErr == nil {
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+				q.drainErr = ctx.Err()
+				logger.Warningf("Shutdown left %d events undelivered", q.undelivered())
+			}
+		}
+		q.stop()
+		close(events)
+	})
+	return q.drainErr
+}
+
+// Makes the ingest queue durable by keeping it in a write-ahead log in
+// dir. Events a previous run didn't get acknowledged are delivered
+// again, consumers must Ack every event. Call before serving requests.
+func (r *RESTService) OpenWAL(dir string) error {
+	return r.queue.open(dir)
+}
+
+// Queues events for Updates() in order, without blocking the caller
+func (r *RESTService) publish(events ...*straumur.Event) error {
+	return r.queue.push(r.QueueSize, events...)
+}
+
+// Response for a failed publish, the queue is full or shutting down
+func unavailable(w http.ResponseWriter, err error) (error, int) {
+	w.Header().Set("Retry-After", "1")
+	return err, http.StatusServiceUnavailable
+}
@@ -0,0 +1,248 @@
+package restservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQueueFull(t *testing.T) {
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.QueueSize = 2
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	post := func() *http.Response {
+		r, err := http.Post(server.URL+"/api/", "application/json", bytes.NewBufferString(`{"key": "queued", "origin": "myapp"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r
+	}
+
+	// The dispatcher holds one event and one waits in the queue
+	for i := 0; i < 2; i++ {
+		if r := post(); r.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected %d, got %d", http.StatusCreated, r.StatusCode)
+		}
+	}
+
+	r := post()
+	if r.StatusCode != http.StatusServiceUnavailable || r.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After, got %d %v", r.StatusCode, r.Header)
+	}
+
+	<-rest.Updates()
+	<-rest.Updates()
+	if r := post(); r.StatusCode != http.StatusCreated {
+		t.Errorf("Expected room after the feed was read, got %d", r.StatusCode)
+	}
+}
+
+// Returns a service keeping its queue in dir
+func walService(t *testing.T, dir string) *RESTService {
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	if err := rest.OpenWAL(dir); err != nil {
+		t.Fatalf("OpenWAL: %v", err)
+	}
+	return rest
+}
+
+func shutdownService(t *testing.T, rest *RESTService) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := rest.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
+
+// Reads the next event, nil if none arrives
+func nextUpdate(rest *RESTService) *straumur.Event {
+	select {
+	case e := <-rest.Updates():
+		return e
+	case <-time.After(200 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestWALRedelivery(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "restservice-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rest := walService(t, dir)
+	first := straumur.NewEvent("wal.first", nil, nil, "", 3, "myapp", []string{"ns/wal"}, nil, nil, nil)
+	second := straumur.NewEvent("wal.second", nil, nil, "", 3, "myapp", []string{"ns/wal"}, nil, nil, nil)
+	if err := rest.publish(first, second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read without acknowledging, as if the consumer crashed
+	if e := nextUpdate(rest); e == nil || e.Key != "wal.first" {
+		t.Fatalf("Expected wal.first, got %+v", e)
+	}
+	if e := nextUpdate(rest); e == nil || e.Key != "wal.second" {
+		t.Fatalf("Expected wal.second, got %+v", e)
+	}
+	shutdownService(t, rest)
+
+	rest = walService(t, dir)
+	e := nextUpdate(rest)
+	if e == nil || e.Key != "wal.first" {
+		t.Fatalf("Expected wal.first to be redelivered, got %+v", e)
+	}
+	rest.Ack(e, nil)
+
+	// A failed save is delivered again
+	e = nextUpdate(rest)
+	if e == nil || e.Key != "wal.second" {
+		t.Fatalf("Expected wal.second to be redelivered, got %+v", e)
+	}
+	rest.Ack(e, errors.New("backend down"))
+	e = nextUpdate(rest)
+	if e == nil || e.Key != "wal.second" {
+		t.Fatalf("Expected wal.second after a failed save, got %+v", e)
+	}
+	rest.Ack(e, nil)
+	shutdownService(t, rest)
+
+	b, err := ioutil.ReadFile(dir + "/" + walName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 0 {
+		t.Errorf("Expected an empty log after every event was acknowledged, got %s", b)
+	}
+
+	rest = walService(t, dir)
+	if e := nextUpdate(rest); e != nil {
+		t.Errorf("Expected no redelivery, got %+v", e)
+	}
+	shutdownService(t, rest)
+}
+
+func TestWALAfterPublish(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "restservice-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	if err := rest.publish(&straumur.Event{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rest.OpenWAL(dir); err == nil {
+		t.Errorf("Expected OpenWAL to fail once events were queued")
+	}
+}
+
+func TestSyncSaveFailureNotRedelivered(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "restservice-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rest := walService(t, dir)
+	saveErr := errors.New("backend down")
+	go func() {
+		e := <-rest.Updates()
+		rest.Ack(e, saveErr)
+	}()
+
+	if err := rest.saveAndWait(&straumur.Event{Key: "wal.sync"}, nil); err != saveErr {
+		t.Fatalf("Expected %v, got %v", saveErr, err)
+	}
+	// The submitter got the error and retries, a redelivery would
+	// store the event twice
+	if e := nextUpdate(rest); e != nil {
+		t.Errorf("Expected no redelivery, got %+v", e)
+	}
+	shutdownService(t, rest)
+
+	rest = walService(t, dir)
+	if e := nextUpdate(rest); e != nil {
+		t.Errorf("Expected the failed event to be gone from the log, got %+v", e)
+	}
+	shutdownService(t, rest)
+}
+
+func TestRedeliveryBackoff(t *testing.T) {
+	for failures, expected := range map[int]time.Duration{
+		1:  redeliverDelay,
+		2:  2 * redeliverDelay,
+		4:  8 * redeliverDelay,
+		50: maxRedeliverDelay,
+	} {
+		if d := backoff(failures); d != expected {
+			t.Errorf("Expected %v after %d failures, got %v", expected, failures, d)
+		}
+	}
+}
+
+func TestFailedSaveDoesNotStall(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "restservice-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rest := walService(t, dir)
+	saveErr := errors.New("rejected")
+	if err := rest.publish(&straumur.Event{Key: "wal.poison"}); err != nil {
+		t.Fatal(err)
+	}
+	poison := nextUpdate(rest)
+	rest.Ack(poison, saveErr)
+
+	// Fresh events go ahead of the one backing off
+	if err := rest.publish(&straumur.Event{Key: "wal.first"}, &straumur.Event{Key: "wal.second"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"wal.first", "wal.second"} {
+		e := nextUpdate(rest)
+		if e == nil || e.Key != key {
+			t.Fatalf("Expected %s, got %+v", key, e)
+		}
+		rest.Ack(e, nil)
+	}
+	poison = nextUpdate(rest)
+	if poison == nil || poison.Key != "wal.poison" {
+		t.Fatalf("Expected wal.poison after its backoff, got %+v", poison)
+	}
+
+	// The last attempt drops it from the queue and the log
+	rest.queue.mu.Lock()
+	rest.queue.inflight[poison].failures = maxSaveAttempts - 1
+	rest.queue.mu.Unlock()
+	rest.Ack(poison, saveErr)
+	if e := nextUpdate(rest); e != nil {
+		t.Errorf("Expected the dead letter to be dropped, got %+v", e)
+	}
+	shutdownService(t, rest)
+
+	rest = walService(t, dir)
+	if e := nextUpdate(rest); e != nil {
+		t.Errorf("Expected an empty log, got %+v", e)
+	}
+	shutdownService(t, rest)
+}
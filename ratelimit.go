@@ -0,0 +1,237 @@
+package restservice
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Buckets idle for this long are full again and are forgotten
+	rateLimitSweepInterval = time.Minute
+	// Keys tracked by a limiter, the least recently used is forgotten
+	DefaultRateLimitKeys = 10000
+)
+
+var (
+	ErrRateLimited = errors.New("Rate limit exceeded")
+)
+
+// Returns the key requests are limited by
+type RateKeyFunc func(req *http.Request) string
+
+// Limits by the authenticated principal, empty when authentication
+// is disabled
+func RateKeyPrincipal(req *http.Request) string {
+	if p := PrincipalFrom(req); p != nil {
+		return p.Name
+	}
+	return ""
+}
+
+// Limits by API key as sent, opt-in. Keys are only known to be valid
+// once authenticated, failed authentications are limited by IP.
+func RateKeyAPIKey(req *http.Request) string {
+	return apiKey(req)
+}
+
+// Limits by the session client id, opt-in. Clients get a new id by
+// dropping the session cookie.
+func RateKeyClient(req *http.Request) string {
+	return req.Header.Get("X-User-Id")
+}
+
+// Limits by remote IP, proxies in front of the service are not taken
+// into account
+func RateKeyIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// Limits by the authenticated principal, falling back on the remote
+// IP. Client supplied keys and session ids are not used as they cost
+// nothing to change.
+func RateKeyDefault(req *http.Request) string {
+	if name := RateKeyPrincipal(req); name != "" {
+		return "principal:" + name
+	}
+	return "ip:" + RateKeyIP(req)
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// Outcome of taking a token
+type RateDecision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Until a token is available and until the bucket is full
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
+// Token bucket rate limiter, every key gets Burst tokens refilled at
+// Rate tokens per second. At most MaxKeys buckets are kept.
+type RateLimiter struct {
+	Rate    float64
+	Burst   int
+	KeyFunc RateKeyFunc
+	MaxKeys int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// Buckets, most recently used first
+	lru       *list.List
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewRateLimiter(rate float64, burst int, key RateKeyFunc) *RateLimiter {
+	if key == nil {
+		key = RateKeyDefault
+	}
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		KeyFunc: key,
+		MaxKeys: DefaultRateLimitKeys,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func (l *RateLimiter) seconds(tokens float64) time.Duration {
+	return time.Duration(tokens / l.Rate * float64(time.Second))
+}
+
+// Takes a token for key
+func (l *RateLimiter) Allow(key string) RateDecision {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	var b *tokenBucket
+	if el, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(el)
+		b = el.Value.(*tokenBucket)
+	} else {
+		if l.MaxKeys > 0 && len(l.buckets) >= l.MaxKeys {
+			l.evict(l.lru.Back())
+		}
+		b = &tokenBucket{key, float64(l.Burst), now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+
+	d := RateDecision{Limit: l.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = l.seconds(1 - b.tokens)
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = l.seconds(float64(l.Burst) - b.tokens)
+	return d
+}
+
+func (l *RateLimiter) evict(el *list.Element) {
+	l.lru.Remove(el)
+	delete(l.buckets, el.Value.(*tokenBucket).key)
+}
+
+// Forgets buckets that have refilled, starting with the least
+// recently used
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	full := l.seconds(float64(l.Burst))
+	for el := l.lru.Back(); el != nil; el = l.lru.Back() {
+		if now.Sub(el.Value.(*tokenBucket).last) < full {
+			break
+		}
+		l.evict(el)
+	}
+}
+
+// Rounds up to whole seconds as the headers require
+func headerSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Sets the RateLimit-* headers, and Retry-After when limited
+func (d RateDecision) writeHeaders(h http.Header) {
+	h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	h.Set("RateLimit-Reset", headerSeconds(d.Reset))
+	if !d.Allowed {
+		h.Set("Retry-After", headerSeconds(d.RetryAfter))
+	}
+}
+
+// Returns the limiter of the route of req. RateLimits is keyed by
+// method and route template, e.g. "POST /api/", "*" covers routes
+// without a limiter of their own.
+func (r *RESTService) rateLimiter(req *http.Request) *RateLimiter {
+	if l, ok := r.RateLimits[req.Method+" "+routeOf(req)]; ok {
+		return l
+	}
+	return r.RateLimits["*"]
+}
+
+// Takes a token for req, false when the request should be rejected.
+// Called once the request is authenticated so it is limited by
+// principal.
+func (r *RESTService) allow(w http.ResponseWriter, req *http.Request) bool {
+	l := r.rateLimiter(req)
+	if l == nil {
+		return true
+	}
+	return r.take(w, req, l, l.KeyFunc(req))
+}
+
+// Takes a token by remote IP for a request that failed to
+// authenticate, so guessing keys is limited too
+func (r *RESTService) allowUnauthorized(w http.ResponseWriter, req *http.Request) bool {
+	l := r.rateLimiter(req)
+	if l == nil {
+		return true
+	}
+	return r.take(w, req, l, "ip:"+RateKeyIP(req))
+}
+
+func (r *RESTService) take(w http.ResponseWriter, req *http.Request, l *RateLimiter, key string) bool {
+	d := l.Allow(key)
+	d.writeHeaders(w.Header())
+	if !d.Allowed {
+		logFor(req).Warningf("Rate limited %s %s", req.Method, routeOf(req))
+	}
+	return d.Allowed
+}
+
+// Takes a token for a subscribe command of c
+func (c *Client) allowSubscribe() bool {
+	if c.limiter == nil {
+		return true
+	}
+	return c.limiter.Allow(c.rateKey).Allowed
+}
@@ -0,0 +1,154 @@
+package restservice
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+
+	now := time.Unix(1000, 0)
+	l := NewRateLimiter(2, 3, nil)
+	l.now = func() time.Time { return now }
+
+	for i := 2; i >= 0; i-- {
+		d := l.Allow("a")
+		if !d.Allowed || d.Remaining != i {
+			t.Errorf("Expected a token with %d remaining, got %+v", i, d)
+		}
+	}
+
+	d := l.Allow("a")
+	if d.Allowed || d.RetryAfter != 500*time.Millisecond || d.Reset != 1500*time.Millisecond {
+		t.Errorf("Expected to be limited, got %+v", d)
+	}
+	if d := l.Allow("b"); !d.Allowed {
+		t.Errorf("Keys should have separate buckets, got %+v", d)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if d := l.Allow("a"); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("Expected a refilled token, got %+v", d)
+	}
+
+	now = now.Add(time.Hour)
+	l.Allow("c")
+	if _, ok := l.buckets["a"]; ok || len(l.buckets) != 1 {
+		t.Errorf("Expected idle buckets to be swept, got %d", len(l.buckets))
+	}
+
+	// Past MaxKeys the least recently used bucket is forgotten
+	l.MaxKeys = 2
+	l.Allow("d")
+	l.Allow("c")
+	l.Allow("e")
+	if _, ok := l.buckets["d"]; ok || len(l.buckets) != 2 {
+		t.Errorf("Expected d to be evicted, got %d buckets", len(l.buckets))
+	}
+}
+
+func TestRateKeys(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "/api/search", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	// Unverified keys and session ids don't pick the bucket
+	req.Header.Set("X-User-Id", "session")
+	req.Header.Set(apiKeyHeader, "secret")
+	if k := RateKeyDefault(req); k != "ip:10.0.0.1" {
+		t.Errorf("Unexpected %s", k)
+	}
+	if RateKeyAPIKey(req) != "secret" || RateKeyClient(req) != "session" {
+		t.Errorf("Expected the opt-in keys, got %q %q", RateKeyAPIKey(req), RateKeyClient(req))
+	}
+	req = withPrincipal(req, &Principal{Name: "producer"})
+	if k := RateKeyDefault(req); k != "principal:producer" {
+		t.Errorf("Unexpected %s", k)
+	}
+}
+
+func TestRateLimitedRoutes(t *testing.T) {
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	keys := NewMemoryKeyStore()
+	keys.Add("producer", &Principal{Name: "producer", Scopes: []string{ScopeAll}})
+	keys.Add("other-producer", &Principal{Name: "other-producer", Scopes: []string{ScopeAll}})
+	rest.Auth = NewAPIKeyAuthenticator(keys)
+	rest.RateLimits = map[string]*RateLimiter{
+		"POST /api/": NewRateLimiter(0.001, 1, RateKeyPrincipal),
+	}
+	rest.WsServer.SubscribeLimiter = NewRateLimiter(0.001, 1, RateKeyIP)
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	go func() {
+		for range rest.Updates() {
+		}
+	}()
+
+	post := func(key string) *http.Response {
+		req, _ := http.NewRequest("POST", server.URL+"/api/", strings.NewReader(`{"key": "limited", "origin": "myapp"}`))
+		req.Header.Set(apiKeyHeader, key)
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r
+	}
+
+	if r := post("producer"); r.StatusCode != http.StatusCreated || r.Header.Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Expected the first request to pass, got %d %v", r.StatusCode, r.Header)
+	}
+	r := post("producer")
+	if r.StatusCode != http.StatusTooManyRequests || r.Header.Get("Retry-After") == "" || r.Header.Get("RateLimit-Limit") != "1" {
+		t.Errorf("Expected 429 with headers, got %d %v", r.StatusCode, r.Header)
+	}
+	if r := post("other-producer"); r.StatusCode != http.StatusCreated {
+		t.Errorf("Expected another key to pass, got %d", r.StatusCode)
+	}
+	// Unknown keys don't get a bucket of their own, failures are
+	// limited by IP
+	if r := post("random"); r.StatusCode != http.StatusUnauthorized || r.Header.Get("RateLimit-Limit") != "1" {
+		t.Errorf("Expected 401 with rate limit headers, got %d %v", r.StatusCode, r.Header)
+	}
+	if r := post("guessed"); r.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected guessing keys to be limited, got %d", r.StatusCode)
+	}
+
+	// Routes without a limiter are not limited
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", server.URL+"/api/search", nil)
+		req.Header.Set(apiKeyHeader, "producer")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if r.StatusCode != http.StatusOK || r.Header.Get("RateLimit-Limit") != "" {
+			t.Errorf("Expected search to be unlimited, got %d", r.StatusCode)
+		}
+	}
+
+	config, _ := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws", "http://localhost/")
+	config.Header.Set(apiKeyHeader, "producer")
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatalf("WebSocket handshake error: %v", err)
+	}
+	defer conn.Close()
+
+	websocket.JSON.Send(conn, Command{Command: CommandSubscribe, Id: "first", Query: &straumur.Query{}})
+	receiveMessage(t, conn, MessageSubscribed)
+	websocket.JSON.Send(conn, Command{Command: CommandSubscribe, Id: "second", Query: &straumur.Query{}})
+	msg := receiveMessage(t, conn, MessageError)
+	if msg.Id != "second" || msg.Code != CodeRateLimited {
+		t.Errorf("Expected the second subscribe to be limited, got %+v", msg)
+	}
+}
@@ -0,0 +1,559 @@
+package restservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/straumur/straumur"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var (
+	ErrSchemaNotFound = errors.New("No schema registered for key pattern")
+)
+
+// JSON Schema for event payloads. Supports the validation keywords of
+// draft 2020-12 for types, enum, const, objects, arrays, strings,
+// numbers and the allOf, anyOf, oneOf and not combinators. Annotations
+// such as title and format are ignored, schemas using any other
+// keyword, e.g. $ref, are rejected rather than half enforced.
+type Schema struct {
+	raw json.RawMessage
+	// Boolean schemas, false rejects every value
+	never bool
+
+	types    []string
+	enum     []interface{}
+	constant interface{}
+	hasConst bool
+
+	properties map[string]*Schema
+	required   []string
+	additional *Schema
+
+	items    *Schema
+	minItems int
+	maxItems int
+
+	minLength int
+	maxLength int
+	pattern   *regexp.Regexp
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+
+	allOf []*Schema
+	anyOf []*Schema
+	oneOf []*Schema
+	not   *Schema
+}
+
+// Parses a JSON Schema, invalid keywords are reported as field errors
+func ParseSchema(b []byte) (*Schema, error) {
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	s, err := compileSchema(doc, "schema")
+	if err != nil {
+		return nil, err
+	}
+	s.raw = append(json.RawMessage(nil), b...)
+	return s, nil
+}
+
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	return s.raw, nil
+}
+
+func schemaError(path, msg string) error {
+	return &ValidationError{[]FieldError{{path, msg}}}
+}
+
+// Keywords compileSchema enforces, and annotations it may ignore
+var schemaKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true,
+	"properties": true, "required": true, "additionalProperties": true,
+	"items": true, "minItems": true, "maxItems": true,
+	"minLength": true, "maxLength": true, "pattern": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true,
+	"allOf": true, "anyOf": true, "oneOf": true, "not": true,
+
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"format": true, "default": true, "examples": true, "deprecated": true,
+	"readOnly": true, "writeOnly": true,
+}
+
+var jsonTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+func compileSchema(doc interface{}, path string) (*Schema, error) {
+
+	s := &Schema{minItems: -1, maxItems: -1, minLength: -1, maxLength: -1}
+
+	if b, ok := doc.(bool); ok {
+		s.never = !b
+		return s, nil
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, schemaError(path, "must be an object or a boolean")
+	}
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !schemaKeywords[key] {
+			return nil, schemaError(path+"."+key, "is not supported")
+		}
+	}
+
+	var err error
+	sub := func(key string, v interface{}) *Schema {
+		if err != nil {
+			return nil
+		}
+		var c *Schema
+		c, err = compileSchema(v, path+"."+key)
+		return c
+	}
+	subs := func(key string) []*Schema {
+		v, ok := m[key]
+		if !ok || err != nil {
+			return nil
+		}
+		list, ok := v.([]interface{})
+		if !ok || len(list) == 0 {
+			err = schemaError(path+"."+key, "must be a non-empty array of schemas")
+			return nil
+		}
+		schemas := make([]*Schema, len(list))
+		for i, v := range list {
+			schemas[i] = sub(fmt.Sprintf("%s.%d", key, i), v)
+		}
+		return schemas
+	}
+	count := func(key string) int {
+		v, ok := m[key]
+		if !ok || err != nil {
+			return -1
+		}
+		n, ok := v.(float64)
+		if !ok || n < 0 || n != math.Trunc(n) {
+			err = schemaError(path+"."+key, "must be a non-negative integer")
+			return -1
+		}
+		return int(n)
+	}
+	number := func(key string) *float64 {
+		v, ok := m[key]
+		if !ok || err != nil {
+			return nil
+		}
+		n, ok := v.(float64)
+		if !ok {
+			err = schemaError(path+"."+key, "must be a number")
+			return nil
+		}
+		return &n
+	}
+
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, _ := v.(string)
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, schemaError(path+".type", "must be a string or an array of strings")
+	}
+	for _, t := range s.types {
+		if !jsonTypes[t] {
+			return nil, schemaError(path+".type", fmt.Sprintf("unknown type %q", t))
+		}
+	}
+
+	if v, ok := m["enum"]; ok {
+		if s.enum, ok = v.([]interface{}); !ok {
+			return nil, schemaError(path+".enum", "must be an array")
+		}
+	}
+	s.constant, s.hasConst = m["const"]
+
+	if v, ok := m["properties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, schemaError(path+".properties", "must be an object")
+		}
+		s.properties = make(map[string]*Schema, len(props))
+		for name, p := range props {
+			s.properties[name] = sub("properties."+name, p)
+		}
+	}
+	if v, ok := m["required"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, schemaError(path+".required", "must be an array of strings")
+		}
+		for _, name := range list {
+			name, ok := name.(string)
+			if !ok {
+				return nil, schemaError(path+".required", "must be an array of strings")
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	if v, ok := m["additionalProperties"]; ok {
+		s.additional = sub("additionalProperties", v)
+	}
+	if v, ok := m["items"]; ok {
+		s.items = sub("items", v)
+	}
+
+	s.minItems = count("minItems")
+	s.maxItems = count("maxItems")
+	s.minLength = count("minLength")
+	s.maxLength = count("maxLength")
+	s.minimum = number("minimum")
+	s.maximum = number("maximum")
+	s.exclusiveMinimum = number("exclusiveMinimum")
+	s.exclusiveMaximum = number("exclusiveMaximum")
+
+	if v, ok := m["pattern"]; ok && err == nil {
+		p, ok := v.(string)
+		if s.pattern, err = regexp.Compile(p); err != nil || !ok {
+			err = schemaError(path+".pattern", "must be a regular expression")
+		}
+	}
+
+	s.allOf = subs("allOf")
+	s.anyOf = subs("anyOf")
+	s.oneOf = subs("oneOf")
+	if v, ok := m["not"]; ok {
+		s.not = sub("not", v)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns the JSON type of a decoded value, integers are numbers
+// without a fraction
+func jsonType(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if n == math.Trunc(n) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+func (s *Schema) hasType(t string) bool {
+	for _, want := range s.types {
+		if want == t || (want == "number" && t == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether v is valid
+func (s *Schema) valid(v interface{}) bool {
+	var errs []FieldError
+	s.validate(v, "", &errs)
+	return len(errs) == 0
+}
+
+// Appends the problems of v to errs, path is the dotted location of v
+func (s *Schema) validate(v interface{}, path string, errs *[]FieldError) {
+
+	fail := func(msg string) {
+		*errs = append(*errs, FieldError{path, msg})
+	}
+
+	if s.never {
+		fail("is not allowed")
+		return
+	}
+
+	t := jsonType(v)
+	if len(s.types) > 0 && !s.hasType(t) {
+		if t == "integer" {
+			t = "number"
+		}
+		fail(fmt.Sprintf("expected %s, got %s", strings.Join(s.types, " or "), t))
+		return
+	}
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+			}
+		}
+		if !found {
+			fail("must be one of the allowed values")
+		}
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constant, v) {
+		fail("must be the constant value")
+	}
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := x[name]; !ok {
+				*errs = append(*errs, FieldError{path + "." + name, "is required"})
+			}
+		}
+		names := make([]string, 0, len(x))
+		for name := range x {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if p, ok := s.properties[name]; ok {
+				p.validate(x[name], path+"."+name, errs)
+			} else if s.additional != nil {
+				if s.additional.never {
+					*errs = append(*errs, FieldError{path + "." + name, "is not an allowed property"})
+				} else {
+					s.additional.validate(x[name], path+"."+name, errs)
+				}
+			}
+		}
+	case []interface{}:
+		if s.minItems >= 0 && len(x) < s.minItems {
+			fail(fmt.Sprintf("must have at least %d items", s.minItems))
+		}
+		if s.maxItems >= 0 && len(x) > s.maxItems {
+			fail(fmt.Sprintf("must have at most %d items", s.maxItems))
+		}
+		if s.items != nil {
+			for i, item := range x {
+				s.items.validate(item, fmt.Sprintf("%s.%d", path, i), errs)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(x)
+		if s.minLength >= 0 && n < s.minLength {
+			fail(fmt.Sprintf("must be at least %d characters", s.minLength))
+		}
+		if s.maxLength >= 0 && n > s.maxLength {
+			fail(fmt.Sprintf("must be at most %d characters", s.maxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(x) {
+			fail("must match " + s.pattern.String())
+		}
+	case float64:
+		if s.minimum != nil && x < *s.minimum {
+			fail(fmt.Sprintf("must be at least %v", *s.minimum))
+		}
+		if s.maximum != nil && x > *s.maximum {
+			fail(fmt.Sprintf("must be at most %v", *s.maximum))
+		}
+		if s.exclusiveMinimum != nil && x <= *s.exclusiveMinimum {
+			fail(fmt.Sprintf("must be greater than %v", *s.exclusiveMinimum))
+		}
+		if s.exclusiveMaximum != nil && x >= *s.exclusiveMaximum {
+			fail(fmt.Sprintf("must be less than %v", *s.exclusiveMaximum))
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, path, errs)
+	}
+	if s.anyOf != nil {
+		matched := false
+		for _, sub := range s.anyOf {
+			if sub.valid(v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match at least one schema of anyOf")
+		}
+	}
+	if s.oneOf != nil {
+		n := 0
+		for _, sub := range s.oneOf {
+			if sub.valid(v) {
+				n++
+			}
+		}
+		if n != 1 {
+			fail("must match exactly one schema of oneOf")
+		}
+	}
+	if s.not != nil && s.not.valid(v) {
+		fail("must not match the schema of not")
+	}
+}
+
+// Schemas by event key pattern, patterns ending in * match keys by
+// prefix. Payloads must be valid against every matching schema.
+type SchemaRegistry struct {
+	mu      sync.RWMutex
+	schemas map[string]*Schema
+}
+
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{schemas: make(map[string]*Schema)}
+}
+
+// Registers s for keys matching pattern, replacing an earlier schema.
+// Returns false when there was none.
+func (r *SchemaRegistry) Set(pattern string, s *Schema) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.schemas[pattern]
+	r.schemas[pattern] = s
+	return ok
+}
+
+func (r *SchemaRegistry) Delete(pattern string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.schemas[pattern]
+	delete(r.schemas, pattern)
+	return ok
+}
+
+// Returns the registered schemas by pattern
+func (r *SchemaRegistry) Schemas() map[string]*Schema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	schemas := make(map[string]*Schema, len(r.schemas))
+	for p, s := range r.schemas {
+		schemas[p] = s
+	}
+	return schemas
+}
+
+// Registers every *.json file in dir, the file name without the
+// extension is the key pattern, e.g. myapp.user.*.json
+func (r *SchemaRegistry) LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		s, err := ParseSchema(b)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		r.Set(strings.TrimSuffix(filepath.Base(file), ".json"), s)
+	}
+	logger.Infof("Loaded %d schemas from %s", len(files), dir)
+	return nil
+}
+
+// Validates the payload of e against the schemas matching its key,
+// returns a *ValidationError listing every problem
+func (r *SchemaRegistry) Validate(e *straumur.Event) error {
+
+	if r == nil || IsTombstone(e) {
+		return nil
+	}
+
+	r.mu.RLock()
+	patterns := make([]string, 0, len(r.schemas))
+	for p := range r.schemas {
+		if matchEntity(p, e.Key) {
+			patterns = append(patterns, p)
+		}
+	}
+	sort.Strings(patterns)
+	schemas := make([]*Schema, len(patterns))
+	for i, p := range patterns {
+		schemas[i] = r.schemas[p]
+	}
+	r.mu.RUnlock()
+
+	var errs []FieldError
+	for _, s := range schemas {
+		s.validate(e.Payload, "payload", &errs)
+	}
+	if len(errs) > 0 {
+		return &ValidationError{errs}
+	}
+	return nil
+}
+
+// GET: /api/schemas
+func (r *RESTService) schemasHandler(w http.ResponseWriter, req *http.Request) (error, int) {
+	enc := json.NewEncoder(w)
+	enc.Encode(r.Schemas.Schemas())
+	return nil, http.StatusOK
+}
+
+// PUT: /api/schemas/pattern
+// Registers the JSON Schema in the body for keys matching pattern
+func (r *RESTService) putSchemaHandler(w http.ResponseWriter, req *http.Request) (error, int) {
+	pattern := mux.Vars(req)["pattern"]
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err, http.StatusBadRequest
+	}
+	s, err := ParseSchema(b)
+	if err != nil {
+		return err, http.StatusBadRequest
+	}
+	status := http.StatusCreated
+	if r.Schemas.Set(pattern, s) {
+		status = http.StatusNoContent
+	}
+	logFor(req).Infof("Registered schema for %s", pattern)
+	w.WriteHeader(status)
+	return nil, status
+}
+
+// DELETE: /api/schemas/pattern
+func (r *RESTService) deleteSchemaHandler(w http.ResponseWriter, req *http.Request) (error, int) {
+	pattern := mux.Vars(req)["pattern"]
+	if !r.Schemas.Delete(pattern) {
+		return ErrSchemaNotFound, http.StatusNotFound
+	}
+	logFor(req).Infof("Removed schema for %s", pattern)
+	w.WriteHeader(http.StatusNoContent)
+	return nil, http.StatusNoContent
+}
@@ -0,0 +1,186 @@
+package restservice
+
+import (
+	"encoding/json"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const userSchema = `{
+	"type": "object",
+	"required": ["name", "age"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"email": {"type": "string", "pattern": "^[^@]+@[^@]+$"},
+		"roles": {"type": "array", "maxItems": 2, "items": {"enum": ["admin", "user"]}}
+	}
+}`
+
+func TestSchemaValidation(t *testing.T) {
+
+	s, err := ParseSchema([]byte(userSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		payload string
+		fields  []FieldError
+	}{
+		{`{"name": "Jane", "age": 30, "roles": ["admin"]}`, nil},
+		{`{"name": "", "age": 1.5}`, []FieldError{
+			{"payload.age", "expected integer, got number"},
+			{"payload.name", "must be at least 1 characters"},
+		}},
+		{`{"age": -1, "nickname": "J"}`, []FieldError{
+			{"payload.name", "is required"},
+			{"payload.age", "must be at least 0"},
+			{"payload.nickname", "is not an allowed property"},
+		}},
+		{`{"name": "J", "age": 1, "email": "nope", "roles": ["root", "user", "admin"]}`, []FieldError{
+			{"payload.email", "must match ^[^@]+@[^@]+$"},
+			{"payload.roles", "must have at most 2 items"},
+			{"payload.roles.0", "must be one of the allowed values"},
+		}},
+		{`"Jane"`, []FieldError{{"payload", "expected object, got string"}}},
+	} {
+		var payload interface{}
+		json.Unmarshal([]byte(c.payload), &payload)
+		var errs []FieldError
+		s.validate(payload, "payload", &errs)
+		if !reflect.DeepEqual(errs, c.fields) {
+			t.Errorf("Validating %s, expected %v, got %v", c.payload, c.fields, errs)
+		}
+	}
+
+	if _, err := ParseSchema([]byte(`{"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "User", "type": "string", "format": "email"}`)); err != nil {
+		t.Errorf("Expected annotations to be allowed, got %v", err)
+	}
+	if _, err := ParseSchema([]byte(`{"minProperties": 1}`)); err == nil || err.Error() != schemaError("schema.minProperties", "is not supported").Error() {
+		t.Errorf("Expected the unsupported keyword to be named, got %v", err)
+	}
+
+	combinators, _ := ParseSchema([]byte(`{"anyOf": [{"type": "string"}, {"type": "null"}], "not": {"const": "forbidden"}}`))
+	for v, valid := range map[interface{}]bool{"ok": true, nil: true, "forbidden": false, 1.0: false} {
+		if combinators.valid(v) != valid {
+			t.Errorf("Expected %v to be valid: %v", v, valid)
+		}
+	}
+
+	for _, invalid := range []string{
+		`{"type": "text"}`,
+		`{"$ref": "#/definitions/user"}`,
+		`{"type": "number", "multipleOf": 2}`,
+		`{"properties": {"tags": {"uniqueItems": true}}}`,
+		`{"if": {"type": "string"}, "then": {"minLength": 1}}`,
+		`{"$defs": {"name": {"type": "string"}}}`,
+		`{"minLength": -1}`,
+		`{"pattern": "("}`,
+		`{"properties": {"a": 1}}`,
+		`[]`,
+	} {
+		if _, err := ParseSchema([]byte(invalid)); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestSchemaRegistry(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "restservice-schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "myapp.user.*.json"), []byte(userSchema), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0644)
+
+	r := NewSchemaRegistry()
+	if err := r.LoadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Schemas()) != 1 {
+		t.Fatalf("Expected a single schema, got %v", r.Schemas())
+	}
+
+	if err := r.Validate(&straumur.Event{Key: "myapp.user.created", Payload: "bad"}); err == nil {
+		t.Errorf("Expected the payload to be rejected")
+	}
+	if err := r.Validate(&straumur.Event{Key: "myapp.order.created", Payload: "fine"}); err != nil {
+		t.Errorf("Expected keys without a schema to pass, got %v", err)
+	}
+	if tombstone := NewTombstone(&straumur.Event{ID: 1, Key: "myapp.user.created"}); r.Validate(tombstone) != nil {
+		t.Errorf("Expected tombstones to pass")
+	}
+}
+
+func TestSchemaRoutes(t *testing.T) {
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	go func() {
+		for range rest.Updates() {
+		}
+	}()
+
+	do := func(method, path, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		b, _ := ioutil.ReadAll(r.Body)
+		return r, string(b)
+	}
+
+	if r, body := do("PUT", "/api/schemas/myapp.user.*", userSchema); r.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d %s", http.StatusCreated, r.StatusCode, body)
+	}
+	if r, _ := do("PUT", "/api/schemas/myapp.user.*", userSchema); r.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected the schema to be replaced, got %d", r.StatusCode)
+	}
+	if r, body := do("PUT", "/api/schemas/other", `{"type": 1}`); r.StatusCode != http.StatusBadRequest || !strings.Contains(body, "schema.type") {
+		t.Errorf("Expected an invalid schema to be rejected, got %d %s", r.StatusCode, body)
+	}
+	if _, body := do("GET", "/api/schemas", ""); !strings.Contains(body, `"myapp.user.*"`) {
+		t.Errorf("Expected the schema to be listed, got %s", body)
+	}
+
+	r, body := do("POST", "/api/", `{"key": "myapp.user.created", "origin": "myapp", "payload": {"name": "Jane"}}`)
+	var resp ErrorResponse
+	json.Unmarshal([]byte(body), &resp)
+	if r.StatusCode != http.StatusBadRequest || resp.Code != CodeValidationFailed || len(resp.Fields) != 1 || resp.Fields[0].Field != "payload.age" {
+		t.Errorf("Expected a field error for age, got %d %s", r.StatusCode, body)
+	}
+	if r, _ := do("POST", "/api/", `{"key": "myapp.user.created", "origin": "myapp", "payload": {"name": "Jane", "age": 30}}`); r.StatusCode != http.StatusCreated {
+		t.Errorf("Expected a valid payload to pass, got %d", r.StatusCode)
+	}
+
+	_, body = do("POST", "/api/bulk", `[{"key": "myapp.user.created", "origin": "myapp", "payload": {"name": "Jane", "age": 30}}, {"key": "myapp.user.created", "origin": "myapp", "payload": {"age": 30}}]`)
+	var results []BulkResult
+	json.Unmarshal([]byte(body), &results)
+	if len(results) != 2 || results[0].Status != bulkAccepted || results[1].Status != bulkRejected || len(results[1].Fields) != 1 {
+		t.Errorf("Expected the second event to be rejected with field errors, got %s", body)
+	}
+
+	if r, _ := do("DELETE", "/api/schemas/myapp.user.*", ""); r.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected %d, got %d", http.StatusNoContent, r.StatusCode)
+	}
+	if r, _ := do("DELETE", "/api/schemas/myapp.user.*", ""); r.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected %d, got %d", http.StatusNotFound, r.StatusCode)
+	}
+}
@@ -4,17 +4,44 @@ import (
 	"code.google.com/p/go.net/websocket"
 	"github.com/straumur/straumur"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type WebSocketServer struct {
-	events  chan *straumur.Event
-	clients map[string]*Client
-	addCh   chan *Client
-	delCh   chan *Client
-	doneCh  chan bool
-	errCh   chan error
-	Filters chan FilterPair
+	// Filter pairing counters, accessed atomically and kept first
+	// for 64-bit alignment
+	filterRetries uint64
+	filterDrops   uint64
+	events        chan *straumur.Event
+	clients       map[string]*Client
+	addCh         chan *Client
+	delCh         chan *Client
+	doneCh        chan bool
+	errCh         chan error
+	Filters       chan FilterPair
+	replayCh      chan replayRequest
+	statsCh       chan chan []ClientStats
+	history       *eventRing
+	// quit is closed by Shutdown, stopped when Run returns
+	quit     chan struct{}
+	stopped  chan struct{}
+	quitOnce sync.Once
+	// Queue size and slow consumer policy of clients added after
+	// they are set
+	BufferSize int
+	Policy     SlowConsumerPolicy
+	// Clients are pinged every PingInterval and disconnected when
+	// nothing has been read from them for IdleTimeout or a write takes
+	// longer than WriteTimeout, zero disables
+	PingInterval time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// Records a span per broadcast when set
+	Tracer *Tracer
+	// Limits subscribe commands of clients added after it is set
+	SubscribeLimiter *RateLimiter
 }
 
 type FilterPair struct {
@@ -33,8 +60,15 @@ func NewWebSocketServer() *WebSocketServer {
 	errCh := make(chan error)
 	events := make(chan *straumur.Event)
 	filters := make(chan FilterPair)
+	replayCh := make(chan replayRequest)
+	statsCh := make(chan chan []ClientStats)
+	history := newEventRing(DefaultHistorySize)
+	quit := make(chan struct{})
+	stopped := make(chan struct{})
 
 	return &WebSocketServer{
+		0,
+		0,
 		events,
 		clients,
 		addCh,
@@ -42,56 +76,108 @@ func NewWebSocketServer() *WebSocketServer {
 		doneCh,
 		errCh,
 		filters,
+		replayCh,
+		statsCh,
+		history,
+		quit,
+		stopped,
+		sync.Once{},
+		DefaultBufferSize,
+		PolicyDisconnect,
+		DefaultPingInterval,
+		DefaultWriteTimeout,
+		DefaultIdleTimeout,
+		nil,
+		nil,
 	}
 }
 
+// Registers c, once Run has stopped c is closed instead
 func (s *WebSocketServer) Add(c *Client) {
-	s.addCh <- c
+	select {
+	case s.addCh <- c:
+	case <-s.stopped:
+		c.close("server stopped")
+	}
 }
 
 func (s *WebSocketServer) Del(c *Client) {
-	s.delCh <- c
+	select {
+	case s.delCh <- c:
+	case <-s.stopped:
+	}
 }
 
 func (s *WebSocketServer) Done() {
 	s.doneCh <- true
 }
 
+// Subscribes c with a command carrying since, missed events are
+// replayed from the broadcast history
+func (s *WebSocketServer) Replay(c *Client, cmd *Command) {
+	select {
+	case s.replayCh <- replayRequest{c, cmd}:
+	case <-s.stopped:
+	}
+}
+
 func (s *WebSocketServer) Err(err error) {
-	s.errCh <- err
+	select {
+	case s.errCh <- err:
+	case <-s.stopped:
+		logger.Errorf("Error after stop: %v", err)
+	}
 }
 
 func (s *WebSocketServer) sendAll(event *straumur.Event) {
+
+	// Continues the trace the event was submitted in
+	span := s.Tracer.startSpan("broadcast", s.Tracer.take(event))
+	defer span.Finish()
+
+	delivered := 0
+	target := matchTarget(event)
 	for _, c := range s.clients {
-		logger.Infof("%s %+v", c.Id, c.query)
-		if c.query.Match(*event) {
-			c.Write(event)
+		if !c.principal.CanRead(event) {
+			continue
+		}
+		if msg, ok := c.match(event, target); ok {
+			c.send(msg)
+			delivered++
 		}
 	}
+
+	span.SetAttribute("event.key", event.Key)
+	span.SetAttribute("clients", len(s.clients))
+	span.SetAttribute("delivered", delivered)
 }
 
 func (s *WebSocketServer) Broadcast(e *straumur.Event) {
-	s.events <- e
+	select {
+	case s.events <- e:
+	case <-s.stopped:
+		logger.Warningf("Dropped broadcast of %s after stop", e.Key)
+	}
 }
 
 func (s *WebSocketServer) GetHandler() http.Handler {
 
 	onConnected := func(ws *websocket.Conn) {
 
+		clientId := ws.Request().Header.Get("X-User-Id")
+		logFor(ws.Request()).Infof("Added client:%s", clientId)
+		client := NewClient(ws, s, clientId)
 		defer func() {
-			err := ws.Close()
+			err := client.close("handler returned")
 			if err != nil {
-				s.errCh <- err
+				s.Err(err)
 			}
 		}()
-		clientId := ws.Request().Header.Get("X-User-Id")
-		logger.Infof("Added client:%s", clientId)
-		client := NewClient(ws, s, clientId)
 		s.Add(client)
 		client.Listen()
 	}
 
-	return websocket.Handler(onConnected)
+	return trackActivity(websocket.Handler(onConnected))
 
 }
 
@@ -106,6 +192,13 @@ func (s *WebSocketServer) FindClientById(uuid string) *Client {
 
 func (s *WebSocketServer) Run(ec chan error) {
 
+	defer close(s.stopped)
+
+	// Once quit is closed every client is closed and Run returns when
+	// the last one is deleted
+	quit := s.quit
+	draining := false
+
 	for {
 		select {
 
@@ -114,6 +207,9 @@ func (s *WebSocketServer) Run(ec chan error) {
 			logger.Debugf("Added new client")
 			s.clients[c.Id] = c
 			logger.Debugf("Now", len(s.clients), "clients connected.")
+			if draining {
+				go c.close("server shutting down")
+			}
 
 		// Attempt to pair the filter with the websocket connection,
 		// requeue in case the client hasn't been added or isn't using
@@ -122,15 +218,20 @@ func (s *WebSocketServer) Run(ec chan error) {
 			client := s.FindClientById(filter.Id)
 			if client != nil {
 				logger.Infof("Client filter matched %s", client.Id)
-				client.query = filter.Query
+				client.setQuery(filter.Query)
 			} else {
 				if filter.Attempts < 3 {
+					atomic.AddUint64(&s.filterRetries, 1)
 					time.AfterFunc(2*time.Second, func() {
 						logger.Infof("Requeing %+v", filter)
 						filter.Attempts++
-						s.Filters <- filter
+						select {
+						case s.Filters <- filter:
+						case <-s.stopped:
+						}
 					})
 				} else {
+					atomic.AddUint64(&s.filterDrops, 1)
 					logger.Infof("Dropping %+v", filter)
 				}
 			}
@@ -139,16 +240,37 @@ func (s *WebSocketServer) Run(ec chan error) {
 		case c := <-s.delCh:
 			logger.Debugf("Delete client")
 			delete(s.clients, c.Id)
+			if draining && len(s.clients) == 0 {
+				return
+			}
 
 		// consume event feed
 		case event := <-s.events:
 			logger.Debugf("Send all:", event)
+			s.history.add(event)
 			s.sendAll(event)
 
+		case req := <-s.replayCh:
+			s.replay(req)
+
+		case ch := <-s.statsCh:
+			ch <- s.clientStats()
+
 		case err := <-s.errCh:
 			logger.Errorf("Error:", err.Error())
 			ec <- err
 
+		case <-quit:
+			quit = nil
+			draining = true
+			logger.Infof("Shutting down, closing %d clients", len(s.clients))
+			if len(s.clients) == 0 {
+				return
+			}
+			for _, c := range s.clients {
+				go c.close("server shutting down")
+			}
+
 		case <-s.doneCh:
 			return
 		}
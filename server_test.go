@@ -102,3 +102,135 @@ func readEvents(ws *websocket.Conn, incoming chan straumur.Event) {
 		}
 	}
 }
+
+func receiveMessage(t *testing.T, conn *websocket.Conn, expected string) Message {
+	var msg Message
+	if err := websocket.JSON.Receive(conn, &msg); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if msg.Type != expected {
+		t.Fatalf("Expected %s message, got %+v", expected, msg)
+	}
+	return msg
+}
+
+func TestWebSocketSubscriptions(t *testing.T) {
+	once.Do(startServer)
+
+	url := fmt.Sprintf("ws://%s%s", serverAddr, "/ws")
+	conn, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("WebSocket handshake error: %v", err)
+	}
+	defer conn.Close()
+
+	commands := []Command{
+		{Command: CommandSubscribe, Id: "moo", Query: &straumur.Query{Entities: []string{"ns/moo"}}},
+		{Command: CommandSubscribe, Id: "foo", Query: &straumur.Query{Entities: []string{"ns/foo"}}},
+		{Command: CommandSubscribe, Id: "bar", Query: &straumur.Query{Entities: []string{"ns/bar"}}},
+	}
+	for _, cmd := range commands {
+		websocket.JSON.Send(conn, cmd)
+		msg := receiveMessage(t, conn, MessageSubscribed)
+		if msg.Id != cmd.Id {
+			t.Errorf("Expected %s, got %+v", cmd.Id, msg)
+		}
+	}
+
+	websocket.JSON.Send(conn, Command{Command: CommandUnsubscribe, Id: "bar"})
+	receiveMessage(t, conn, MessageUnsubscribed)
+
+	websocket.JSON.Send(conn, Command{Command: CommandUnsubscribe, Id: "bar"})
+	receiveMessage(t, conn, MessageError)
+
+	websocket.JSON.Send(conn, Command{Command: CommandList})
+	msg := receiveMessage(t, conn, MessageSubscriptions)
+	if len(msg.Queries) != 2 {
+		t.Errorf("Expected 2 subscriptions, got %+v", msg.Queries)
+	}
+
+	broadcaster.Broadcast(straumur.NewEvent(
+		"subscriptions.both",
+		nil,
+		nil,
+		"Matches both subscriptions",
+		3,
+		"myapp",
+		[]string{"ns/foo", "ns/moo"},
+		nil,
+		nil,
+		nil))
+
+	msg = receiveMessage(t, conn, MessageEvent)
+	if msg.Event.Key != "subscriptions.both" || fmt.Sprint(msg.Subscriptions) != "[foo moo]" {
+		t.Errorf("Unexpected %+v", msg)
+	}
+
+	broadcaster.Broadcast(straumur.NewEvent(
+		"subscriptions.foo",
+		nil,
+		nil,
+		"Matches one subscription",
+		3,
+		"myapp",
+		[]string{"ns/foo"},
+		nil,
+		nil,
+		nil))
+
+	msg = receiveMessage(t, conn, MessageEvent)
+	if msg.Event.Key != "subscriptions.foo" || fmt.Sprint(msg.Subscriptions) != "[foo]" {
+		t.Errorf("Unexpected %+v", msg)
+	}
+}
+
+func TestWebSocketReplay(t *testing.T) {
+	once.Do(startServer)
+
+	for i := 1001; i <= 1003; i++ {
+		e := straumur.NewEvent(
+			"replay.test",
+			nil,
+			nil,
+			"Broadcast before subscribing",
+			3,
+			"myapp",
+			[]string{"ns/replay"},
+			nil,
+			nil,
+			nil)
+		e.ID = i
+		broadcaster.Broadcast(e)
+	}
+
+	url := fmt.Sprintf("ws://%s%s", serverAddr, "/ws")
+	conn, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("WebSocket handshake error: %v", err)
+	}
+	defer conn.Close()
+
+	since := 1001
+	websocket.JSON.Send(conn, Command{
+		Command: CommandSubscribe,
+		Id:      "replay",
+		Query:   &straumur.Query{Entities: []string{"ns/replay"}},
+		Since:   &since,
+	})
+	msg := receiveMessage(t, conn, MessageSubscribed)
+	if msg.Truncated || fmt.Sprint(ids(msg.Events)) != "[1002 1003]" {
+		t.Errorf("Unexpected replay %v, truncated: %t", ids(msg.Events), msg.Truncated)
+	}
+
+	since = 1
+	websocket.JSON.Send(conn, Command{
+		Command: CommandSubscribe,
+		Id:      "old",
+		Query:   &straumur.Query{Entities: []string{"ns/replay"}},
+		Since:   &since,
+	})
+	msg = receiveMessage(t, conn, MessageSubscribed)
+	if !msg.Truncated || len(msg.Events) != 3 {
+		t.Errorf("Unexpected replay %v, truncated: %t", ids(msg.Events), msg.Truncated)
+	}
+}
@@ -0,0 +1,72 @@
+package restservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Upper bound for Close, use Shutdown to pick a deadline
+const DefaultShutdownTimeout = 30 * time.Second
+
+var (
+	ErrShuttingDown = errors.New("Service is shutting down")
+)
+
+// Stops accepting writes, waits for pending events to be delivered to
+// Updates() and closes it, then disconnects every websocket and stream
+// client. Returns once everything has finished or ctx is done.
+//
+// Call Shutdown before shutting down the http.Server, which otherwise
+// waits for the streams to end.
+func (r *RESTService) Shutdown(ctx context.Context) error {
+
+	logger.Infof("Shutting down")
+
+	err := r.queue.shutdown(ctx, r.events)
+	if wsErr := r.WsServer.Shutdown(ctx); err == nil {
+		err = wsErr
+	}
+	return err
+}
+
+// Closes every client, websocket clients receive a close frame, and
+// stops Run once they are all gone
+func (s *WebSocketServer) Shutdown(ctx context.Context) error {
+
+	s.quitOnce.Do(func() { close(s.quit) })
+
+	select {
+	case <-s.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shuts down every tenant, see RESTService.Shutdown
+func (m *MultiTenantService) Shutdown(ctx context.Context) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(m.tenants))
+	for _, r := range m.tenants {
+		wg.Add(1)
+		go func(r *RESTService) {
+			defer wg.Done()
+			errs <- r.Shutdown(ctx)
+		}(r)
+	}
+	wg.Wait()
+	close(errs)
+
+	var first error
+	for err := range errs {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,104 @@
+package restservice
+
+import (
+	"bytes"
+	"code.google.com/p/go.net/websocket"
+	"context"
+	"encoding/json"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws", "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("WebSocket handshake error: %v", err)
+	}
+	defer conn.Close()
+
+	post := func() *http.Response {
+		b, _ := json.Marshal(straumur.NewEvent("shutdown.test", nil, nil, "", 3, "myapp", []string{"ns/shutdown"}, nil, nil, nil))
+		r, err := http.Post(server.URL+"/api/", "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r
+	}
+
+	// Nobody reads the feed until shutdown has begun, the events must
+	// still be delivered
+	for i := 0; i < 3; i++ {
+		if r := post(); r.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected %d, got %d", http.StatusCreated, r.StatusCode)
+		}
+	}
+
+	received := make(chan int)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		n := 0
+		for range rest.Updates() {
+			n++
+		}
+		received <- n
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := rest.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if n := <-received; n != 3 {
+		t.Errorf("Expected 3 drained events, got %d", n)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var msg json.RawMessage
+	if err := websocket.JSON.Receive(conn, &msg); err == nil {
+		t.Errorf("Expected the connection to be closed, got %s", msg)
+	}
+
+	if r := post(); r.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d after shutdown, got %d", http.StatusServiceUnavailable, r.StatusCode)
+	}
+
+	// The broadcaster has stopped and must not block
+	rest.WsServer.Broadcast(&straumur.Event{Key: "late"})
+	if stats := rest.WsServer.Stats(); len(stats) != 0 {
+		t.Errorf("Expected no clients, got %+v", stats)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	if err := rest.publish(&straumur.Event{Key: "stuck"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := rest.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	if _, ok := <-rest.Updates(); ok {
+		t.Errorf("Expected the feed to be closed without the dropped event")
+	}
+	if err := rest.publish(&straumur.Event{}); err != ErrShuttingDown {
+		t.Errorf("Expected %v, got %v", ErrShuttingDown, err)
+	}
+}
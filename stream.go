@@ -0,0 +1,210 @@
+package restservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nu7hatch/gouuid"
+	"github.com/straumur/straumur"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	streamKeepAlive   = 15 * time.Second
+	lastEventIdHeader = "Last-Event-ID"
+)
+
+var (
+	ErrStreamingUnsupported = errors.New("Streaming unsupported")
+	ErrInvalidLastEventId   = errors.New("Invalid Last-Event-ID")
+)
+
+// Creates a client without a websocket connection, broadcasts are
+// read from its channel by the stream handler
+func newStreamClient(server *WebSocketServer, id string, q straumur.Query, p *Principal) *Client {
+	return &Client{
+		Id:        id,
+		principal: p,
+		server:    server,
+		ch:        make(chan interface{}, server.BufferSize),
+		doneCh:    make(chan bool),
+		closed:    make(chan struct{}),
+		policy:    server.Policy,
+		query:     q,
+	}
+}
+
+// Writes a single server-sent event
+func writeStreamEvent(w http.ResponseWriter, e *straumur.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.ID, b)
+	return err
+}
+
+// Passes the stored events matching q with an ID above lastId to
+// write, oldest first, a page at a time from the position of lastId.
+// Returns the cursor after the last event written, to resume from.
+func (r *RESTService) replayMissed(req *http.Request, q straumur.Query, lastId int, c *cursor, write func(*straumur.Event) error) (*cursor, error) {
+
+	if c == nil {
+		// Towards newer events from lastId, or from the start
+		c = &cursor{Prev: true}
+		if last, err := r.backend(req).GetById(lastId); err == nil && last != nil {
+			c = cursorFor(last, true)
+		}
+	}
+	p := PrincipalFrom(req)
+
+	for {
+		narrowed := q
+		c.narrow(&narrowed)
+		events, _, err := r.queryAll(req, []straumur.Query{narrowed}, 0)
+		if err != nil {
+			return c, err
+		}
+		missed := []*straumur.Event{}
+		for _, e := range p.Filter(events) {
+			if e.ID > lastId {
+				missed = append(missed, e)
+			}
+		}
+		page := paginate(missed, c, r.PageSize)
+		for i := len(page.Events) - 1; i >= 0; i-- {
+			if err := write(page.Events[i]); err != nil {
+				return c, err
+			}
+		}
+		if len(page.Events) > 0 {
+			c = cursorFor(page.Events[0], true)
+		}
+		if page.Prev == nil {
+			return c, nil
+		}
+	}
+}
+
+// GET: /api/stream
+// Streams broadcasts matching the query params as text/event-stream,
+// a Last-Event-ID header replays stored events missed since that ID
+func (r *RESTService) streamHandler(w http.ResponseWriter, req *http.Request) (error, int) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return ErrStreamingUnsupported, http.StatusInternalServerError
+	}
+
+	q, err := getQuery(req)
+	if err != nil {
+		return err, http.StatusBadRequest
+	}
+	p := PrincipalFrom(req)
+	if err := p.CheckQuery(q); err != nil {
+		return err, http.StatusForbidden
+	}
+
+	lastId := 0
+	if s := req.Header.Get(lastEventIdHeader); s != "" {
+		lastId, err = strconv.Atoi(s)
+		if err != nil {
+			return ErrInvalidLastEventId, http.StatusBadRequest
+		}
+	}
+
+	u4, err := uuid.NewV4()
+	if err != nil {
+		return err, http.StatusInternalServerError
+	}
+
+	// Register before replaying so nothing is lost in between, the
+	// buffer holds live events until the replay is done
+	c := newStreamClient(r.WsServer, req.Header.Get("X-User-Id")+"/stream/"+u4.String(), *q, p)
+	r.WsServer.Add(c)
+	defer r.WsServer.Del(c)
+
+	logFor(req).Infof("Added stream client:%s", c.Id)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Events broadcast while replaying are buffered in c.ch and may
+	// already have been sent, skip those once. Broadcasts that don't
+	// fit are dropped rather than disconnecting the client, they are
+	// stored and picked up by a last pass once the replay is done.
+	replayed := make(map[int]bool)
+	if lastId > 0 {
+		write := func(e *straumur.Event) error {
+			if replayed[e.ID] {
+				return nil
+			}
+			if err := writeStreamEvent(w, e); err != nil {
+				return err
+			}
+			replayed[e.ID] = true
+			flusher.Flush()
+			return nil
+		}
+		atomic.StoreInt32(&c.replaying, 1)
+		pos, err := r.replayMissed(req, *q, lastId, nil, write)
+		atomic.StoreInt32(&c.replaying, 0)
+		if err == nil {
+			_, err = r.replayMissed(req, *q, lastId, pos, write)
+		}
+		if err != nil {
+			logFor(req).Errorf("Replay failed for %s: %v", c.Id, err)
+		}
+	}
+	buffered := len(c.ch)
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+
+		case msg := <-c.ch:
+			// Stream clients have no subscriptions, only plain
+			// events are queued for them
+			e, ok := msg.(*straumur.Event)
+			if !ok {
+				continue
+			}
+			if buffered > 0 {
+				buffered--
+				if replayed[e.ID] {
+					continue
+				}
+			}
+			if err := writeStreamEvent(w, e); err != nil {
+				return nil, http.StatusOK
+			}
+			atomic.AddUint64(&c.sent, 1)
+			flusher.Flush()
+
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil, http.StatusOK
+			}
+			flusher.Flush()
+
+		case <-req.Context().Done():
+			logFor(req).Infof("Stream client disconnected:%s", c.Id)
+			return nil, http.StatusOK
+
+		case <-c.closed:
+			logFor(req).Infof("Closed stream client:%s", c.Id)
+			return nil, http.StatusOK
+
+		case <-r.WsServer.quit:
+			logFor(req).Infof("Closing stream client %s: server shutting down", c.Id)
+			return nil, http.StatusOK
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package restservice
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-querystring/query"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Reads the next server-sent event, skipping comments
+func readStreamEvent(t *testing.T, rd *bufio.Reader) (string, straumur.Event) {
+	var id string
+	var event straumur.Event
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && id != "":
+			return id, event
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	once.Do(startServer)
+
+	q := straumur.Query{}
+	q.Entities = []string{"ns/moo"}
+	v, err := query.Values(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("http://%s/stream?%s", serverAddr, v.Encode())
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(lastEventIdHeader, "1")
+	r, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+
+	if ct := r.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected Content-Type %s", ct)
+	}
+
+	rd := bufio.NewReader(r.Body)
+
+	id, event := readStreamEvent(t, rd)
+	if id != "2" || event.Key != secondEvent.Key {
+		t.Errorf("Expected replay of event 2, got %s: %+v", id, event)
+	}
+
+	broadcaster.Broadcast(straumur.NewEvent(
+		"Should filter",
+		nil,
+		nil,
+		"This event should be filtered",
+		3,
+		"myapp",
+		[]string{"ns/boo"},
+		nil,
+		nil,
+		nil))
+
+	broadcaster.Broadcast(straumur.NewEvent(
+		"stream.live",
+		nil,
+		nil,
+		"This event should pass",
+		3,
+		"myapp",
+		[]string{"ns/moo"},
+		nil,
+		nil,
+		nil))
+
+	_, event = readStreamEvent(t, rd)
+	if event.Key != "stream.live" {
+		t.Errorf("Unexpected %+v", event)
+	}
+}
+
+// Backend broadcasting a new event on each of the first few queries,
+// as if they were saved while a stream replays
+type broadcastingStore struct {
+	straumur.DataBackend
+	rest  *RESTService
+	count int
+}
+
+func (b *broadcastingStore) Query(q straumur.Query) ([]*straumur.Event, error) {
+	if b.count < 6 {
+		b.count++
+		e := straumur.NewEvent("stream.live", nil, nil, "Saved during replay", 3, "myapp", []string{"ns/replay"}, nil, nil, nil)
+		if err := b.DataBackend.Save(e); err != nil {
+			return nil, err
+		}
+		b.rest.WsServer.Broadcast(e)
+	}
+	return b.DataBackend.Query(q)
+}
+
+func TestEventStreamLongReplay(t *testing.T) {
+
+	d := straumur.NewLocalMemoryStore()
+	for i := 0; i < 30; i++ {
+		if err := d.Save(straumur.NewEvent("stream.replay", nil, nil, "Stored", 3, "myapp", []string{"ns/replay"}, nil, nil, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backend := &broadcastingStore{DataBackend: d}
+	rest := NewRESTService(backend, make(chan error, 4))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.PageSize = 4
+	rest.WsServer.BufferSize = 2
+	backend.rest = rest
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/api/stream?entities=ns/replay", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(lastEventIdHeader, "5")
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+
+	// Stored events after 5 and those saved while replaying arrive in
+	// order, although the live ones overflowed the buffer
+	rd := bufio.NewReader(r.Body)
+	for want := 6; want <= 36; want++ {
+		id, _ := readStreamEvent(t, rd)
+		if id != strconv.Itoa(want) {
+			t.Fatalf("Expected event %d, got %s", want, id)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package restservice
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownTenant = errors.New("Unknown tenant")
+	ErrMissingTenant = errors.New("Missing tenant")
+)
+
+// Picks the tenant a request belongs to. Resolvers may return a
+// modified request, e.g. with the tenant prefix removed from the path.
+type TenantResolver interface {
+	Resolve(req *http.Request) (string, *http.Request, error)
+}
+
+// Resolves tenants by the Host header, ports are ignored
+type HostResolver struct {
+	Hosts map[string]string
+}
+
+func (h *HostResolver) Resolve(req *http.Request) (string, *http.Request, error) {
+	host := req.Host
+	if hp, _, err := net.SplitHostPort(host); err == nil {
+		host = hp
+	}
+	tenant, ok := h.Hosts[strings.ToLower(host)]
+	if !ok {
+		return "", req, ErrUnknownTenant
+	}
+	return tenant, req, nil
+}
+
+// Resolves tenants by the first path segment, /acme/api/search is
+// served as /api/search by the tenant acme
+type PathPrefixResolver struct{}
+
+func (PathPrefixResolver) Resolve(req *http.Request) (string, *http.Request, error) {
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	i := strings.Index(path, "/")
+	if i <= 0 {
+		return "", req, ErrMissingTenant
+	}
+	tenant := path[:i]
+
+	r := req.WithContext(context.WithValue(req.Context(), basePathKey, "/"+tenant))
+	u := *req.URL
+	u.Path = path[i:]
+	u.RawPath = ""
+	r.URL = &u
+	return tenant, r, nil
+}
+
+// Returns the path prefix a resolver removed from the request path,
+// links in responses have to include it
+func basePath(req *http.Request) string {
+	p, _ := req.Context().Value(basePathKey).(string)
+	return p
+}
+
+// Resolves tenants by the Tenant of the authenticated principal. The
+// request carries the principal, tenants check its scopes and
+// policies without authenticating it again. Websocket upgrades may
+// authenticate with a connect token instead when Tokens is set.
+type PrincipalResolver struct {
+	Auth   Authenticator
+	Tokens *TokenSigner
+}
+
+func (p *PrincipalResolver) Resolve(req *http.Request) (string, *http.Request, error) {
+	if token := connectToken(req); token != "" && p.Tokens != nil {
+		return p.resolveToken(req, token)
+	}
+	principal, err := p.Auth.Authenticate(req)
+	if err != nil {
+		return "", req, err
+	}
+	if principal.Tenant == "" {
+		return "", req, ErrMissingTenant
+	}
+	return principal.Tenant, withPrincipal(req, principal), nil
+}
+
+// Resolves the tenant a connect token was issued for, which has to be
+// the tenant of its principal
+func (p *PrincipalResolver) resolveToken(req *http.Request, token string) (string, *http.Request, error) {
+	claims, err := p.Tokens.claims(token)
+	if err != nil {
+		return "", req, err
+	}
+	if claims.Principal == nil || claims.Principal.Tenant == "" || claims.Principal.Tenant != claims.Tenant {
+		return "", req, ErrInvalidToken
+	}
+	return claims.Tenant, withPrincipal(req, claims.Principal), nil
+}
+
+// Serves several tenants from one process. Every tenant is a separate
+// RESTService with its own DataBackend, event feed and WebSocketServer
+// so queries, aggregates and broadcasts never cross tenants.
+type MultiTenantService struct {
+	Resolver TenantResolver
+	mu       sync.RWMutex
+	tenants  map[string]*RESTService
+}
+
+func NewMultiTenantService(resolver TenantResolver) *MultiTenantService {
+	return &MultiTenantService{
+		Resolver: resolver,
+		tenants:  make(map[string]*RESTService),
+	}
+}
+
+// Registers the service of a tenant, consumers read its events from
+// r.Updates()
+func (m *MultiTenantService) Add(tenant string, r *RESTService) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r.tenant = tenant
+	m.tenants[tenant] = r
+}
+
+// Returns the service of a tenant, nil if there is none
+func (m *MultiTenantService) Tenant(tenant string) *RESTService {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tenants[tenant]
+}
+
+func (m *MultiTenantService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	tenant, tenantReq, err := m.Resolver.Resolve(req)
+	if err == nil && m.Tenant(tenant) == nil {
+		err = ErrUnknownTenant
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case ErrUnknownTenant:
+			status = http.StatusNotFound
+		case ErrUnauthorized, ErrInvalidToken, ErrExpiredToken:
+			status = http.StatusUnauthorized
+		case ErrMissingTenant:
+			status = http.StatusBadRequest
+		}
+		logFor(req).Warningf("Unable to resolve tenant for %s: %v", req.URL, err)
+		writeError(w, req, err, status)
+		return
+	}
+
+	m.Tenant(tenant).ServeHTTP(w, tenantReq)
+}
+
+// Shuts down every tenant with DefaultShutdownTimeout
+func (m *MultiTenantService) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	return m.Shutdown(ctx)
+}
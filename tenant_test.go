@@ -0,0 +1,150 @@
+package restservice
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// KeyStore whose backing store is down
+type failingKeyStore struct{}
+
+func (failingKeyStore) Lookup(key string) (*Principal, error) {
+	return nil, errors.New("key store unavailable")
+}
+
+func TestTenantResolvers(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "http://acme.example.com:8080/api/search", nil)
+	hosts := &HostResolver{map[string]string{"acme.example.com": "acme"}}
+	if tenant, _, err := hosts.Resolve(req); err != nil || tenant != "acme" {
+		t.Errorf("Expected acme, got %q, %v", tenant, err)
+	}
+
+	req, _ = http.NewRequest("GET", "http://example.com/acme/api/search?key=a", nil)
+	tenant, tenantReq, err := PathPrefixResolver{}.Resolve(req)
+	if err != nil || tenant != "acme" || tenantReq.URL.Path != "/api/search" || tenantReq.URL.RawQuery != "key=a" {
+		t.Errorf("Unexpected %q, %s, %v", tenant, tenantReq.URL, err)
+	}
+	if basePath(tenantReq) != "/acme" || basePath(req) != "" {
+		t.Errorf("Expected the prefix to be kept for links, got %q", basePath(tenantReq))
+	}
+	if req.URL.Path != "/acme/api/search" {
+		t.Errorf("The original request was modified: %s", req.URL)
+	}
+
+	req, _ = http.NewRequest("GET", "http://example.com/", nil)
+	if _, _, err := (PathPrefixResolver{}).Resolve(req); err != ErrMissingTenant {
+		t.Errorf("Expected %v, got %v", ErrMissingTenant, err)
+	}
+
+	keys := NewMemoryKeyStore()
+	keys.Add("acme-key", &Principal{Name: "acme", Tenant: "acme"})
+	principals := &PrincipalResolver{Auth: NewAPIKeyAuthenticator(keys)}
+	req, _ = http.NewRequest("GET", "http://example.com/api/search", nil)
+	req.Header.Set(apiKeyHeader, "acme-key")
+	tenant, tenantReq, err = principals.Resolve(req)
+	if err != nil || tenant != "acme" || PrincipalFrom(tenantReq).Name != "acme" {
+		t.Errorf("Expected acme with its principal, got %q, %v", tenant, err)
+	}
+}
+
+func TestMultiTenantService(t *testing.T) {
+
+	m := NewMultiTenantService(PathPrefixResolver{})
+	for _, tenant := range []string{"acme", "globex"} {
+		d := straumur.NewLocalMemoryStore()
+		d.Save(&straumur.Event{Key: tenant, Entities: []string{"user/foo"}})
+		rest := NewRESTService(d, make(chan error))
+		rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+		m.Add(tenant, rest)
+	}
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	for _, tenant := range []string{"acme", "globex"} {
+		r, err := http.Get(server.URL + "/" + tenant + "/api/user/foo/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		events := []straumur.Event{}
+		json.NewDecoder(r.Body).Decode(&events)
+		r.Body.Close()
+		if len(events) != 1 || events[0].Key != tenant {
+			t.Errorf("%s: expected only its own events, got %+v", tenant, events)
+		}
+	}
+
+	r, err := http.Get(server.URL + "/initech/api/search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected %d for an unknown tenant, got %d", http.StatusNotFound, r.StatusCode)
+	}
+
+	// Links are relative to the tenant prefix
+	go func() {
+		for e := range m.Tenant("acme").Updates() {
+			m.Tenant("acme").Ack(e, m.Tenant("acme").databackend.Save(e))
+		}
+	}()
+	r, err = http.Post(server.URL+"/acme/api/?sync=true", "application/json", strings.NewReader(`{"key": "acme", "origin": "myapp", "entities": ["user/foo"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusCreated || !strings.HasPrefix(r.Header.Get("Location"), "/acme/api/") {
+		t.Errorf("Expected a location under the tenant, got %d %q", r.StatusCode, r.Header.Get("Location"))
+	}
+	r, err = http.Get(server.URL + "/acme/api/search?limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if link := r.Header.Get("Link"); !strings.HasPrefix(link, "</acme/api/search?") {
+		t.Errorf("Expected a link under the tenant, got %q", link)
+	}
+}
+
+func TestPrincipalTenants(t *testing.T) {
+
+	keys := NewMemoryKeyStore()
+	keys.Add("reader", &Principal{Name: "reader", Tenant: "acme", Scopes: []string{ScopeEventsRead}})
+	m := NewMultiTenantService(&PrincipalResolver{Auth: NewAPIKeyAuthenticator(keys)})
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	m.Add("acme", rest)
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	do := func(method, path string) int {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(`{"key": "acme", "origin": "myapp"}`))
+		req.Header.Set(apiKeyHeader, "reader")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r.StatusCode
+	}
+
+	// The tenant has no Auth of its own, the resolved principal applies
+	if status := do("GET", "/api/search"); status != http.StatusOK {
+		t.Errorf("Expected %d, got %d", http.StatusOK, status)
+	}
+	if status := do("POST", "/api/"); status != http.StatusForbidden {
+		t.Errorf("Expected the scopes of the principal to apply, got %d", status)
+	}
+
+	m.Resolver = &PrincipalResolver{Auth: NewAPIKeyAuthenticator(failingKeyStore{})}
+	if status := do("GET", "/api/search"); status != http.StatusInternalServerError {
+		t.Errorf("Expected a key store failure to be a server error, got %d", status)
+	}
+}
@@ -0,0 +1,88 @@
+package restservice
+
+import (
+	"errors"
+	"github.com/straumur/straumur"
+	"strings"
+	"time"
+)
+
+const (
+	// Key of events that mark a deleted event
+	TombstoneKey = "straumur.tombstone"
+	// KeyParams entry holding the key of the deleted event
+	tombstoneKeyParam = "deleted_key"
+)
+
+var (
+	ErrReservedKey = errors.New("Key is reserved for tombstones, use DELETE")
+)
+
+// Creates a tombstone replacing e. The tombstone keeps the ID and the
+// references of e so it is stored over the deleted event and reaches
+// the subscribers that received it.
+func NewTombstone(e *straumur.Event) *straumur.Event {
+	return &straumur.Event{
+		ID:              e.ID,
+		Key:             TombstoneKey,
+		KeyParams:       map[string]interface{}{tombstoneKeyParam: e.Key},
+		Created:         e.Created,
+		Updated:         time.Now(),
+		Importance:      e.Importance,
+		Origin:          e.Origin,
+		Entities:        e.Entities,
+		OtherReferences: e.OtherReferences,
+		Actors:          e.Actors,
+		Tags:            e.Tags,
+	}
+}
+
+// Reports whether e marks a deleted event
+func IsTombstone(e *straumur.Event) bool {
+	return e.Key == TombstoneKey
+}
+
+// Checks a submitted event isn't a tombstone, those are only created
+// by DELETE
+func checkKey(e *straumur.Event) error {
+	if IsTombstone(e) {
+		return ErrReservedKey
+	}
+	return nil
+}
+
+// Reports whether a query for key may return tombstones
+func queriesTombstones(key string) bool {
+	if key == "" {
+		return true
+	}
+	for _, k := range strings.Split(key, " OR ") {
+		if strings.TrimSpace(k) == TombstoneKey {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the event subscriptions should be matched against, for
+// tombstones this is the deleted event
+func matchTarget(e *straumur.Event) straumur.Event {
+	target := *e
+	if IsTombstone(e) {
+		if k, ok := e.KeyParams[tombstoneKeyParam].(string); ok {
+			target.Key = k
+		}
+	}
+	return target
+}
+
+// Removes tombstones from a result set
+func withoutTombstones(events []*straumur.Event) []*straumur.Event {
+	out := make([]*straumur.Event, 0, len(events))
+	for _, e := range events {
+		if !IsTombstone(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
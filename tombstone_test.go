@@ -0,0 +1,134 @@
+package restservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/straumur/straumur"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTombstoneMatch(t *testing.T) {
+
+	e := straumur.NewEvent(
+		"myapp.user.login",
+		nil,
+		nil,
+		"User foobar logged in",
+		3,
+		"myapp",
+		[]string{"user/foo"},
+		nil,
+		nil,
+		nil)
+	e.ID = 7
+
+	tombstone := NewTombstone(e)
+	if !IsTombstone(tombstone) || tombstone.ID != e.ID {
+		t.Fatalf("Unexpected tombstone %+v", tombstone)
+	}
+
+	q := straumur.Query{Key: "myapp.user.login", Entities: []string{"user/foo"}}
+	if q.Match(*tombstone) {
+		t.Errorf("Query %+v should not match the raw tombstone", q)
+	}
+	if !q.Match(matchTarget(tombstone)) {
+		t.Errorf("Query %+v should match the tombstone of %+v", q, e)
+	}
+
+	events := withoutTombstones([]*straumur.Event{e, tombstone})
+	if len(events) != 1 || events[0] != e {
+		t.Errorf("Unexpected events %+v", events)
+	}
+}
+
+func TestDeleteEvent(t *testing.T) {
+	once.Do(startServer)
+
+	e := straumur.Event{
+		Key:      "myapp.user.mistake",
+		Origin:   "myapp",
+		Entities: []string{"ns/mistake"},
+		Actors:   []string{"mistaken"},
+	}
+	r := postJSON(t, fmt.Sprintf("http://%s/?sync=true", serverAddr), &e)
+	var deleted straumur.Event
+	json.NewDecoder(r.Body).Decode(&deleted)
+	r.Body.Close()
+	if r.StatusCode != http.StatusCreated {
+		t.Fatalf("Status code expected %d, got %d", http.StatusCreated, r.StatusCode)
+	}
+
+	url := fmt.Sprintf("http://%s%s", serverAddr[:len(serverAddr)-len("/api")], r.Header.Get("Location"))
+
+	for _, status := range []int{http.StatusOK, http.StatusGone} {
+		req, err := http.NewRequest("DELETE", url+"?sync=true", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err = client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if r.StatusCode != status {
+			t.Errorf("DELETE: status code expected %d, got %d", status, r.StatusCode)
+		}
+	}
+
+	r, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusGone {
+		t.Errorf("GET: status code expected %d, got %d", http.StatusGone, r.StatusCode)
+	}
+
+	// Deleted events stay deleted
+	r = putJSON(t, url+"?sync=true", &straumur.Event{ID: deleted.ID, Key: "myapp.user.mistake", Origin: "myapp"})
+	r.Body.Close()
+	if r.StatusCode != http.StatusGone {
+		t.Errorf("PUT: status code expected %d, got %d", http.StatusGone, r.StatusCode)
+	}
+
+	r = postJSON(t, fmt.Sprintf("http://%s/", serverAddr), &straumur.Event{Key: TombstoneKey, Origin: "myapp"})
+	var apiErr ErrorResponse
+	json.NewDecoder(r.Body).Decode(&apiErr)
+	r.Body.Close()
+	if r.StatusCode != http.StatusBadRequest || apiErr.Code != CodeReservedKey {
+		t.Errorf("POST: expected tombstones to be rejected, got %d %+v", r.StatusCode, apiErr)
+	}
+	r, err = client.Post(fmt.Sprintf("http://%s/bulk", serverAddr), "application/json", strings.NewReader(`[{"key": "`+TombstoneKey+`"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []BulkResult
+	json.NewDecoder(r.Body).Decode(&results)
+	r.Body.Close()
+	if len(results) != 1 || results[0].Code != CodeReservedKey {
+		t.Errorf("Bulk: expected tombstones to be rejected, got %+v", results)
+	}
+	r = postJSON(t, fmt.Sprintf("http://%s/?sync=true", serverAddr), &e)
+	var stored straumur.Event
+	json.NewDecoder(r.Body).Decode(&stored)
+	r.Body.Close()
+	patch, _ := http.NewRequest("PATCH", fmt.Sprintf("http://%s/%d/", serverAddr, stored.ID), strings.NewReader(`{"key": "`+TombstoneKey+`"}`))
+	patch.Header.Set("Content-Type", mergePatchType)
+	r, err = client.Do(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusBadRequest {
+		t.Errorf("PATCH: expected tombstones to be rejected, got %d", r.StatusCode)
+	}
+
+	// Only the event that wasn't deleted is counted
+	counts := map[string]int{}
+	getJSON(t, fmt.Sprintf("http://%s/aggregate/actors?entities=ns/mistake", serverAddr), &counts)
+	if counts["mistaken"] != 1 {
+		t.Errorf("Expected deleted events to be left out of aggregates, got %v", counts)
+	}
+}
@@ -0,0 +1,406 @@
+package restservice
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/straumur/straumur"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	traceparentHeader = "traceparent"
+	// Submitted events whose trace context is kept for their broadcast
+	maxTracedEvents = 10000
+)
+
+// Identifies a span within a trace, see the W3C Trace Context spec
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// Formats the context as a traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// Parses a traceparent header value, ok is false for malformed values
+// and all-zero ids
+func ParseTraceparent(s string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// Version 00 has exactly four fields, later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// A timed operation. Methods are safe to call on a nil span, which is
+// what disabled tracing hands out.
+type Span struct {
+	Name       string                 `json:"name"`
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+
+	mu       sync.Mutex
+	context  SpanContext
+	exporter Exporter
+	ended    bool
+}
+
+// Returns the span context, used as parent of child spans
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// Marks the span as failed, nil errors are ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = err.Error()
+}
+
+// Ends the span and hands it to the exporter, only the first call has
+// an effect
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.context.Sampled {
+		s.exporter.ExportSpan(s)
+	}
+}
+
+// Receives finished spans
+type Exporter interface {
+	ExportSpan(s *Span)
+}
+
+// Keeps finished spans in memory, meant for tests
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (m *MemoryExporter) ExportSpan(s *Span) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spans = append(m.spans, s)
+}
+
+// Returns the spans exported so far
+func (m *MemoryExporter) Spans() []*Span {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Span(nil), m.spans...)
+}
+
+func (m *MemoryExporter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spans = nil
+}
+
+// Writes finished spans as JSON lines, e.g. to os.Stdout
+type WriterExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+func (e *WriterExporter) ExportSpan(s *Span) {
+	s.mu.Lock()
+	b, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		logger.Errorf("Unable to export span %s: %v", s.Name, err)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(append(b, '\n'))
+}
+
+// Starts spans and passes them to Exporter. Keeps the trace context
+// events were submitted in, in process, so their save and broadcast
+// continue that trace. A nil Tracer disables tracing.
+type Tracer struct {
+	Exporter Exporter
+
+	mu        sync.Mutex
+	submitted map[*straumur.Event]*list.Element
+	// Oldest first, dropped beyond maxTracedEvents
+	order *list.List
+}
+
+type submittedEvent struct {
+	event   *straumur.Event
+	context SpanContext
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{Exporter: exporter}
+}
+
+// Remembers the trace context e was submitted in
+func (t *Tracer) track(e *straumur.Event, sc SpanContext) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.submitted == nil {
+		t.submitted = make(map[*straumur.Event]*list.Element)
+		t.order = list.New()
+	}
+	if el, ok := t.submitted[e]; ok {
+		t.order.Remove(el)
+	}
+	t.submitted[e] = t.order.PushBack(&submittedEvent{e, sc})
+	for t.order.Len() > maxTracedEvents {
+		oldest := t.order.Remove(t.order.Front()).(*submittedEvent)
+		delete(t.submitted, oldest.event)
+	}
+}
+
+// Returns the trace context e was submitted in
+func (t *Tracer) lookup(e *straumur.Event) (SpanContext, bool) {
+	if t == nil {
+		return SpanContext{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	el, ok := t.submitted[e]
+	if !ok {
+		return SpanContext{}, false
+	}
+	return el.Value.(*submittedEvent).context, true
+}
+
+// Returns and forgets the trace context e was submitted in
+func (t *Tracer) take(e *straumur.Event) SpanContext {
+	if t == nil {
+		return SpanContext{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	el, ok := t.submitted[e]
+	if !ok {
+		return SpanContext{}
+	}
+	t.order.Remove(el)
+	delete(t.submitted, e)
+	return el.Value.(*submittedEvent).context
+}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		logger.Errorf("%v", err)
+	}
+}
+
+// Starts a span, parent is used when valid, otherwise a new trace is
+// started
+func (t *Tracer) startSpan(name string, parent SpanContext) *Span {
+	if t == nil {
+		return nil
+	}
+
+	sc := SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}
+	parentId := ""
+	if parent.TraceID == [16]byte{} {
+		randomBytes(sc.TraceID[:])
+		sc.Sampled = true
+	} else {
+		parentId = hex.EncodeToString(parent.SpanID[:])
+	}
+	randomBytes(sc.SpanID[:])
+
+	return &Span{
+		Name:       name,
+		TraceID:    hex.EncodeToString(sc.TraceID[:]),
+		SpanID:     hex.EncodeToString(sc.SpanID[:]),
+		ParentID:   parentId,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+		context:    sc,
+		exporter:   t.Exporter,
+	}
+}
+
+// Starts a span as child of the span in ctx and returns a context
+// carrying the new span
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	span := t.startSpan(name, SpanFrom(ctx).Context())
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+// Returns the span of ctx, nil if there is none
+func SpanFrom(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
+
+// Starts the span of an HTTP request, continuing the trace of an
+// incoming traceparent header
+func (t *Tracer) startRequest(req *http.Request, name string) (*http.Request, *Span) {
+	if t == nil {
+		return req, nil
+	}
+	parent := SpanFrom(req.Context()).Context()
+	if remote, ok := ParseTraceparent(req.Header.Get(traceparentHeader)); ok && parent.TraceID == [16]byte{} {
+		parent = remote
+	}
+	span := t.startSpan(name, parent)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.route", routeOf(req))
+	span.SetAttribute("request_id", RequestIdFrom(req))
+	return req.WithContext(context.WithValue(req.Context(), spanKey, span)), span
+}
+
+// Keeps the trace context of the request for the broadcast of e
+func (r *RESTService) traceEvent(req *http.Request, e *straumur.Event) {
+	if span := SpanFrom(req.Context()); span != nil {
+		r.tracer.track(e, span.Context())
+	}
+}
+
+// Returns the trace context an event read from Updates() was
+// submitted in, so the consumer's spans for saving it join the trace
+// of the request, e.g. by passing Traceparent() on. ok is false when
+// tracing is disabled or the event has been broadcast.
+func (r *RESTService) TraceContext(e *straumur.Event) (SpanContext, bool) {
+	return r.tracer.lookup(e)
+}
+
+// Sets the tracer of the service and its broadcaster, call before
+// serving requests
+func (r *RESTService) SetTracer(t *Tracer) {
+	r.tracer = t
+	r.WsServer.Tracer = t
+}
+
+// DataBackend recording a span for every call
+type tracedBackend struct {
+	straumur.DataBackend
+	tracer *Tracer
+	ctx    context.Context
+}
+
+func (b *tracedBackend) GetById(id int) (*straumur.Event, error) {
+	_, span := b.tracer.Start(b.ctx, "backend.GetById")
+	defer span.Finish()
+	span.SetAttribute("event.id", id)
+	e, err := b.DataBackend.GetById(id)
+	span.SetError(err)
+	return e, err
+}
+
+func (b *tracedBackend) Save(e *straumur.Event) error {
+	_, span := b.tracer.Start(b.ctx, "backend.Save")
+	defer span.Finish()
+	err := b.DataBackend.Save(e)
+	span.SetError(err)
+	return err
+}
+
+func (b *tracedBackend) Query(q straumur.Query) ([]*straumur.Event, error) {
+	_, span := b.tracer.Start(b.ctx, "backend.Query")
+	defer span.Finish()
+	events, err := b.DataBackend.Query(q)
+	span.SetAttribute("results", len(events))
+	span.SetError(err)
+	return events, err
+}
+
+// Only called when the traced DataBackend implements LimitQuerier
+func (b *tracedBackend) QueryLimit(q straumur.Query, limit int) ([]*straumur.Event, error) {
+	_, span := b.tracer.Start(b.ctx, "backend.QueryLimit")
+	defer span.Finish()
+	span.SetAttribute("limit", limit)
+	events, err := b.DataBackend.(LimitQuerier).QueryLimit(q, limit)
+	span.SetAttribute("results", len(events))
+	span.SetError(err)
+	return events, err
+}
+
+func (b *tracedBackend) AggregateType(q straumur.Query, s string) (map[string]int, error) {
+	_, span := b.tracer.Start(b.ctx, "backend.AggregateType")
+	defer span.Finish()
+	span.SetAttribute("aggregate.type", s)
+	m, err := b.DataBackend.AggregateType(q, s)
+	span.SetError(err)
+	return m, err
+}
+
+// Returns the DataBackend to use for req, traced when tracing is
+// enabled
+func (r *RESTService) backend(req *http.Request) straumur.DataBackend {
+	if r.tracer == nil {
+		return r.databackend
+	}
+	return &tracedBackend{r.databackend, r.tracer, req.Context()}
+}
@@ -0,0 +1,120 @@
+package restservice
+
+import (
+	"bytes"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+
+	valid := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(valid)
+	if !ok || !sc.Sampled || sc.Traceparent() != valid {
+		t.Errorf("Expected %s to round trip, got %+v %v", valid, sc, ok)
+	}
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(s); ok {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+
+	if sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"); !ok || sc.Sampled {
+		t.Errorf("Expected an unsampled context, got %+v", sc)
+	}
+}
+
+// Returns the exported spans named name
+func spansNamed(exporter *MemoryExporter, name string) []*Span {
+	spans := []*Span{}
+	for _, s := range exporter.Spans() {
+		if s.Name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+
+	exporter := &MemoryExporter{}
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.SetTracer(NewTracer(exporter))
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest("POST", server.URL+"/api/", bytes.NewBufferString(`{"key": "traced", "origin": "myapp"}`))
+	req.Header.Set("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	posts := spansNamed(exporter, "HTTP POST /api/")
+	if len(posts) != 1 || posts[0].TraceID != traceId || posts[0].ParentID != "00f067aa0ba902b7" {
+		t.Fatalf("Expected a span continuing the incoming trace, got %+v", posts)
+	}
+	if posts[0].Attributes["http.status_code"] != http.StatusCreated {
+		t.Errorf("Unexpected attributes %+v", posts[0].Attributes)
+	}
+	if tp := r.Header.Get("traceparent"); tp != "00-"+traceId+"-"+posts[0].SpanID+"-01" {
+		t.Errorf("Expected the request span in the response, got %q", tp)
+	}
+
+	e := <-rest.Updates()
+	if _, ok := e.KeyParams["traceparent"]; ok || len(e.KeyParams) != 1 {
+		t.Errorf("Expected only the request id on the stored event, got %+v", e.KeyParams)
+	}
+	// The consumer can continue the trace while saving
+	if sc, ok := rest.TraceContext(e); !ok || sc.Traceparent() != r.Header.Get("traceparent") {
+		t.Errorf("Expected the submit context for the consumer, got %+v %v", sc, ok)
+	}
+
+	// Fan-out of the event continues its trace
+	rest.WsServer.Broadcast(e)
+	var broadcasts []*Span
+	for i := 0; i < 50 && len(broadcasts) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		broadcasts = spansNamed(exporter, "broadcast")
+	}
+	if len(broadcasts) != 1 || broadcasts[0].TraceID != traceId || broadcasts[0].ParentID != posts[0].SpanID {
+		t.Errorf("Expected a broadcast span in the trace, got %+v", broadcasts)
+	}
+	if sc := rest.tracer.take(e); sc.TraceID != [16]byte{} {
+		t.Errorf("Expected the trace context to be dropped after the broadcast")
+	}
+
+	r, err = http.Get(server.URL + "/api/search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	searches := spansNamed(exporter, "HTTP GET /api/search")
+	queries := spansNamed(exporter, "backend.Query")
+	if len(searches) != 1 || len(queries) != 1 {
+		t.Fatalf("Expected a search and a query span, got %+v", exporter.Spans())
+	}
+	if queries[0].TraceID != searches[0].TraceID || queries[0].ParentID != searches[0].SpanID {
+		t.Errorf("Expected the query span to be a child of the request span")
+	}
+	if searches[0].ParentID != "" {
+		t.Errorf("Expected a new trace without traceparent, got parent %s", searches[0].ParentID)
+	}
+}
@@ -0,0 +1,184 @@
+package restservice
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTokenTTL = time.Minute
+	tokenParam      = "token"
+)
+
+var (
+	ErrInvalidToken     = errors.New("Invalid connect token")
+	ErrExpiredToken     = errors.New("Connect token has expired")
+	ErrTokensDisabled   = errors.New("Connect tokens are not enabled")
+	ErrOriginNotAllowed = errors.New("Origin not allowed to open websocket connections")
+)
+
+// Issues and verifies short-lived connect tokens for websocket
+// connections. Browsers can't send API keys on the upgrade request so
+// they fetch a token over REST and pass it as ?token= instead.
+type TokenSigner struct {
+	Secret []byte
+	TTL    time.Duration
+}
+
+func NewTokenSigner(secret []byte) *TokenSigner {
+	return &TokenSigner{secret, DefaultTokenTTL}
+}
+
+type tokenClaims struct {
+	Principal *Principal `json:"principal"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Expires   int64      `json:"exp"`
+}
+
+func (t *TokenSigner) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, t.Secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Returns a token for p and the time it expires. The token is only
+// valid for tenant, empty outside a MultiTenantService.
+func (t *TokenSigner) Issue(p *Principal, tenant string) (string, time.Time, error) {
+	expires := time.Now().Add(t.TTL)
+	payload, err := json.Marshal(tokenClaims{p, tenant, expires.Unix()})
+	if err != nil {
+		return "", expires, err
+	}
+	enc := base64.RawURLEncoding
+	token := enc.EncodeToString(payload) + "." + enc.EncodeToString(t.sign(payload))
+	return token, expires, nil
+}
+
+// Returns the principal a token was issued for, tokens issued for
+// another tenant are invalid
+func (t *TokenSigner) Verify(token, tenant string) (*Principal, error) {
+	claims, err := t.claims(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Tenant != tenant {
+		return nil, ErrInvalidToken
+	}
+	return claims.Principal, nil
+}
+
+func (t *TokenSigner) claims(token string) (*tokenClaims, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, t.sign(payload)) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() > claims.Expires {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+// Returns the connect token of a websocket upgrade, tokens are not
+// accepted on other requests
+func connectToken(req *http.Request) string {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || !strings.HasSuffix(req.URL.Path, "/api/ws") {
+		return ""
+	}
+	return req.URL.Query().Get(tokenParam)
+}
+
+// Reports whether a browser origin may open websocket connections,
+// an empty allowlist allows every origin
+func (r *RESTService) originAllowed(origin string) bool {
+	if len(r.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, o := range r.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// POST: /api/ws/token
+// Issues a connect token for the authenticated caller
+func (r *RESTService) tokenHandler(w http.ResponseWriter, req *http.Request) (error, int) {
+
+	if r.Tokens == nil {
+		return ErrTokensDisabled, http.StatusNotFound
+	}
+
+	token, expires, err := r.Tokens.Issue(PrincipalFrom(req), r.tenant)
+	if err != nil {
+		return err, http.StatusInternalServerError
+	}
+
+	enc := json.NewEncoder(w)
+	enc.Encode(map[string]interface{}{
+		"token":   token,
+		"expires": expires,
+	})
+	return nil, http.StatusOK
+}
+
+// Checks the handshake origin and authenticates the upgrade with a
+// connect token, falling back on the credentials of the request
+func (r *RESTService) wsHandler(f http.HandlerFunc) http.HandlerFunc {
+
+	scoped := r.ScopedHandler(ScopeEventsRead, f)
+
+	return func(w http.ResponseWriter, req *http.Request) {
+
+		requestId(req)
+
+		if origin := req.Header.Get("Origin"); !r.originAllowed(origin) {
+			logFor(req).Warningf("Rejected websocket origin %s", origin)
+			writeError(w, req, ErrOriginNotAllowed, http.StatusForbidden)
+			return
+		}
+
+		token := connectToken(req)
+		if token == "" || r.Tokens == nil {
+			scoped(w, req)
+			return
+		}
+
+		p, err := r.Tokens.Verify(token, r.tenant)
+		if err != nil {
+			writeError(w, req, err, http.StatusUnauthorized)
+			return
+		}
+		if r.Auth != nil && !p.HasScope(ScopeEventsRead) {
+			writeError(w, req, ErrForbidden, http.StatusForbidden)
+			return
+		}
+		req = withPrincipal(req, p)
+		if !r.allow(w, req) {
+			writeError(w, req, ErrRateLimited, http.StatusTooManyRequests)
+			return
+		}
+		f(w, req)
+	}
+}
@@ -0,0 +1,212 @@
+package restservice
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"github.com/gorilla/sessions"
+	"github.com/straumur/straumur"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenSigner(t *testing.T) {
+
+	signer := NewTokenSigner([]byte("token-secret"))
+	p := &Principal{Name: "dashboard", Scopes: []string{ScopeEventsRead}, Entities: []string{"teama/*"}}
+
+	token, expires, err := signer.Issue(p, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires.Before(time.Now()) {
+		t.Errorf("Token expired when issued, %v", expires)
+	}
+
+	verified, err := signer.Verify(token, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.Name != p.Name || !verified.HasScope(ScopeEventsRead) || len(verified.Entities) != 1 {
+		t.Errorf("Expected %+v, got %+v", p, verified)
+	}
+
+	// Tokens are bound to the tenant they were issued for
+	acme, _, _ := signer.Issue(p, "acme")
+	if _, err := signer.Verify(acme, "globex"); err != ErrInvalidToken {
+		t.Errorf("Expected a token of another tenant to be invalid, got %v", err)
+	}
+	if _, err := signer.Verify(acme, "acme"); err != nil {
+		t.Errorf("Expected the token to be valid for its tenant, got %v", err)
+	}
+
+	other := NewTokenSigner([]byte("other-secret"))
+	for _, bad := range []string{"", "garbage", token + "x", strings.Replace(token, ".", ".x", 1)} {
+		if _, err := signer.Verify(bad, ""); err != ErrInvalidToken {
+			t.Errorf("%q: expected %v, got %v", bad, ErrInvalidToken, err)
+		}
+	}
+	if _, err := other.Verify(token, ""); err != ErrInvalidToken {
+		t.Errorf("Expected %v, got %v", ErrInvalidToken, err)
+	}
+
+	signer.TTL = -time.Minute
+	expired, _, _ := signer.Issue(p, "")
+	if _, err := signer.Verify(expired, ""); err != ErrExpiredToken {
+		t.Errorf("Expected %v, got %v", ErrExpiredToken, err)
+	}
+}
+
+func TestWebSocketConnectToken(t *testing.T) {
+
+	keys := NewMemoryKeyStore()
+	keys.Add("teama-key", &Principal{
+		Name:     "teama",
+		Scopes:   []string{ScopeEventsRead},
+		Entities: []string{"teama/*"},
+	})
+
+	rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+	rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+	rest.Auth = NewAPIKeyAuthenticator(keys)
+	rest.Tokens = NewTokenSigner([]byte("token-secret"))
+	rest.AllowedOrigins = []string{"http://dashboard.example.com"}
+	server := httptest.NewServer(rest)
+	defer server.Close()
+
+	r, err := http.Post(server.URL+"/api/ws/token", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %d, got %d", http.StatusUnauthorized, r.StatusCode)
+	}
+
+	req, _ := http.NewRequest("POST", server.URL+"/api/ws/token", nil)
+	req.Header.Set(apiKeyHeader, "teama-key")
+	r, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issued struct {
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}
+	json.NewDecoder(r.Body).Decode(&issued)
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK || issued.Token == "" {
+		t.Fatalf("Expected a token, got %d %+v", r.StatusCode, issued)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws"
+
+	rejected := []struct {
+		Query  string
+		Origin string
+	}{
+		{"", "http://dashboard.example.com"},
+		{"?token=garbage", "http://dashboard.example.com"},
+		{"?token=" + issued.Token, "http://evil.example.com"},
+	}
+	for _, test := range rejected {
+		if conn, err := websocket.Dial(wsURL+test.Query, "", test.Origin); err == nil {
+			conn.Close()
+			t.Errorf("%s from %s: expected the handshake to fail", test.Query, test.Origin)
+		}
+	}
+
+	conn, err := websocket.Dial(wsURL+"?token="+issued.Token, "", "http://dashboard.example.com")
+	if err != nil {
+		t.Fatalf("WebSocket handshake error: %v", err)
+	}
+	defer conn.Close()
+
+	websocket.JSON.Send(conn, Command{Command: CommandSubscribe, Id: "mine", Query: &straumur.Query{Entities: []string{"teama/user/1"}}})
+	receiveMessage(t, conn, MessageSubscribed)
+
+	websocket.JSON.Send(conn, Command{Command: CommandSubscribe, Id: "theirs", Query: &straumur.Query{Entities: []string{"teamb/user/1"}}})
+	msg := receiveMessage(t, conn, MessageError)
+	if msg.Code != CodeEntityForbidden {
+		t.Errorf("Expected %s, got %+v", CodeEntityForbidden, msg)
+	}
+}
+
+func TestMultiTenantConnectTokens(t *testing.T) {
+
+	signer := NewTokenSigner([]byte("token-secret"))
+	keys := NewMemoryKeyStore()
+	keys.Add("acme-key", &Principal{Name: "acme", Tenant: "acme", Scopes: []string{ScopeEventsRead}})
+
+	newTenant := func() *RESTService {
+		rest := NewRESTService(straumur.NewLocalMemoryStore(), make(chan error))
+		rest.Store = sessions.NewCookieStore([]byte("something-very-secret"))
+		rest.Tokens = signer
+		return rest
+	}
+
+	issue := func(url string) string {
+		req, _ := http.NewRequest("POST", url, nil)
+		req.Header.Set(apiKeyHeader, "acme-key")
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		var issued struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(r.Body).Decode(&issued)
+		if issued.Token == "" {
+			t.Fatalf("Expected a token, got %d", r.StatusCode)
+		}
+		return issued.Token
+	}
+
+	// Tenants resolved by principal accept tokens on the upgrade
+	byPrincipal := NewMultiTenantService(&PrincipalResolver{Auth: NewAPIKeyAuthenticator(keys), Tokens: signer})
+	byPrincipal.Add("acme", newTenant())
+	server := httptest.NewServer(byPrincipal)
+	defer server.Close()
+
+	token := issue(server.URL + "/api/ws/token")
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws?token="+token, "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("WebSocket handshake error: %v", err)
+	}
+	conn.Close()
+
+	// but not as credentials for other requests
+	r, err := http.Get(server.URL + "/api/search?token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %d, got %d", http.StatusUnauthorized, r.StatusCode)
+	}
+
+	// A signer shared across tenants doesn't let a token cross them
+	byPath := NewMultiTenantService(PathPrefixResolver{})
+	for _, tenant := range []string{"acme", "globex"} {
+		rest := newTenant()
+		rest.Auth = NewAPIKeyAuthenticator(keys)
+		byPath.Add(tenant, rest)
+	}
+	pathServer := httptest.NewServer(byPath)
+	defer pathServer.Close()
+
+	token = issue(pathServer.URL + "/acme/api/ws/token")
+	wsURL := "ws" + strings.TrimPrefix(pathServer.URL, "http")
+	if conn, err := websocket.Dial(wsURL+"/globex/api/ws?token="+token, "", "http://localhost/"); err == nil {
+		conn.Close()
+		t.Errorf("Expected the token of acme to be rejected by globex")
+	}
+	conn, err = websocket.Dial(wsURL+"/acme/api/ws?token="+token, "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("WebSocket handshake error: %v", err)
+	}
+	conn.Close()
+}